@@ -11,10 +11,14 @@ import (
 	"time"
 
 	"job_runner/config"
+	"job_runner/redact"
 	"job_runner/server"
 )
 
 func main() {
+	// Log through a handler that masks credentials, since errors may quote a DSN
+	slog.SetDefault(slog.New(redact.NewHandler(slog.NewTextHandler(os.Stderr, nil))))
+
 	// Parse command line flags
 	configFile := flag.String("config", "", "Path to config file")
 	httpAddr := flag.String("http.addr", "", "HTTP server address (overrides config)")
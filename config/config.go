@@ -4,7 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"time"
+
+	"job_runner/metric"
+	"job_runner/redact"
 )
 
 // Duration is a wrapper around time.Duration to allow for custom JSON unmarshaling.
@@ -49,6 +54,124 @@ type Config struct {
 	QueryMetricName       string            `json:"query_metric_name"`
 	QueryStatusMetricName string            `json:"query_status_metric_name"`
 	HTTPCheckTaskTimeout  Duration          `json:"http_check_task_timeout,omitempty"` // Added for HTTP check tasks
+	PoolIdleTimeout       Duration          `json:"pool_idle_timeout"`                 // Idle time after which a cached connection pool is closed
+	MaxPools              int               `json:"max_pools"`                         // Connection pools kept open at once, the least recently used is closed first; 0 means no limit
+
+	// QuerySkippedRowsMetricName names the metric that counts the result rows of a query
+	// skipped because a value could not be converted to a number. Empty disables it.
+	QuerySkippedRowsMetricName string `json:"query_skipped_rows_metric_name"`
+
+	// DataSources maps a source name (used as /sql?source=<name>) to its connection details.
+	DataSources map[string]DataSource `json:"data_sources,omitempty"`
+	// DisableRawCredentials rejects /sql requests that carry connection parameters
+	// (type, username, password, host, port, db) instead of a named source.
+	DisableRawCredentials bool `json:"disable_raw_credentials"`
+	// SecretEnv lists the environment variables that data sources and driver parameters may
+	// reference as ${env:NAME}. Other variables cannot be referenced.
+	SecretEnv []string `json:"secret_env,omitempty"`
+
+	// Queries is the query catalog: named queries callable as /sql?query_name=<name>.
+	Queries map[string]QueryDefinition `json:"queries,omitempty"`
+	// CatalogOnly rejects ad-hoc SQL passed in the query parameter; only catalog queries can run.
+	CatalogOnly bool `json:"catalog_only"`
+
+	// ConstLabels are added to every series of every task's output, unless the series
+	// already has a label with the same name.
+	ConstLabels map[string]string `json:"const_labels,omitempty"`
+	// UTF8Names keeps metric and label names that are not valid classic Prometheus names
+	// (e.g. column aliases with spaces) and quotes them, instead of replacing invalid
+	// characters with underscores. Requires Prometheus 3.0 or later.
+	UTF8Names bool `json:"utf8_names"`
+
+	// Limits bound the output of every task. Data sources can override them.
+	Limits Limits `json:"limits"`
+
+	// CacheMaxEntries is the number of cached task outputs kept per data source (ad-hoc
+	// requests share one cache). Data sources can override it. Zero means no limit.
+	CacheMaxEntries int `json:"cache_max_entries"`
+}
+
+// Limits bound the output of a task. Zero values mean no limit.
+type Limits struct {
+	MaxSeries        int    `json:"max_series,omitempty"`         // Series in the output
+	MaxRows          int    `json:"max_rows,omitempty"`           // Result rows read by SQL tasks
+	MaxResponseBytes int    `json:"max_response_bytes,omitempty"` // Size of the output, not counting status metrics
+	OnLimit          string `json:"on_limit,omitempty"`           // truncate (default) or fail
+}
+
+// Policies for output that exceeds a limit.
+const (
+	OnLimitTruncate = "truncate" // Drop what does not fit and report the truncation
+	OnLimitFail     = "fail"     // Fail the request
+)
+
+// validate checks that the limits are not negative and the policy is known.
+func (l Limits) validate() error {
+	if l.MaxSeries < 0 || l.MaxRows < 0 || l.MaxResponseBytes < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	switch l.OnLimit {
+	case "", OnLimitTruncate, OnLimitFail:
+		return nil
+	default:
+		return fmt.Errorf("unsupported on_limit policy %q (supported: fail, truncate)", l.OnLimit)
+	}
+}
+
+// QueryDefinition is a named query from the query catalog.
+// Empty fields fall back to the request parameters and then to the global defaults.
+type QueryDefinition struct {
+	SQL             string   `json:"sql"`
+	ValueColumn     string   `json:"value_column,omitempty"`     // "none" selects info mode
+	Mode            string   `json:"mode,omitempty"`             // value (default), info, row_count or wide
+	ValueColumns    []string `json:"value_columns,omitempty"`    // Columns exposed as separate metrics, "column" or "column:metric_name"
+	NameColumn      string   `json:"name_column,omitempty"`      // Column whose value is used as the metric name
+	TimestampColumn string   `json:"timestamp_column,omitempty"` // Column holding the timestamp of each sample
+	MetricPrefix    string   `json:"metric_prefix,omitempty"`
+	Source          string   `json:"source,omitempty"`       // Data source used when the request names none
+	MetricType      string   `json:"metric_type,omitempty"`  // counter, gauge (default), histogram, summary or untyped
+	Help            string   `json:"help,omitempty"`         // HELP text of the generated metrics
+	OnDuplicate     string   `json:"on_duplicate,omitempty"` // error (default), first, last, sum, max or min
+	NullValue       string   `json:"null_value,omitempty"`   // What NULL values become: skip (default), zero or nan
+	Stream          bool     `json:"stream,omitempty"`       // Stream the results as the rows are read, see the stream parameter
+	MinInterval     Duration `json:"min_interval,omitempty"` // Serve the cached output of the query for this long, see the cache_ttl parameter
+	// Histogram and summary options, see the buckets, bucket_column, sum_column and quantiles parameters.
+	Buckets      []float64 `json:"buckets,omitempty"`
+	BucketColumn string    `json:"bucket_column,omitempty"`
+	SumColumn    string    `json:"sum_column,omitempty"`
+	Quantiles    []float64 `json:"quantiles,omitempty"`
+	// Label shaping options, see the label_columns, drop_columns, rename, const_label.<name>
+	// and null_label_value parameters. Rename maps column names to label names.
+	LabelColumns   []string          `json:"label_columns,omitempty"`
+	DropColumns    []string          `json:"drop_columns,omitempty"`
+	Rename         map[string]string `json:"rename,omitempty"`
+	ConstLabels    map[string]string `json:"const_labels,omitempty"`
+	NullLabelValue string            `json:"null_label_value,omitempty"`
+	// ArgTypes declares the type (string, int, float, time) of bind arguments,
+	// keyed by 1-based position for "arg" or by name for "arg.<name>".
+	ArgTypes map[string]string `json:"arg_types,omitempty"`
+}
+
+// DataSource describes a named database connection defined in the config file.
+type DataSource struct {
+	Type     string `json:"type"`
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Database string `json:"database"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// AllowWrites turns off the read-only guard for this source: statements are no longer
+	// classified and do not run in a read-only transaction. Leave it off unless needed.
+	AllowWrites bool `json:"allow_writes,omitempty"`
+	// ConnOptions holds the effective connection options for this source.
+	// Fields set in the config file override the global connection_options;
+	// LoadConfig fills in everything else from the global values.
+	ConnOptions *ConnectionOptions `json:"connection_options,omitempty"`
+	// Limits holds the effective output limits for this source, filled in from the
+	// global limits like ConnOptions.
+	Limits *Limits `json:"limits,omitempty"`
+	// CacheMaxEntries overrides the global cache_max_entries for this source unless zero.
+	CacheMaxEntries int `json:"cache_max_entries,omitempty"`
 }
 
 // ConnectionOptions defines database connection parameters
@@ -77,9 +200,13 @@ func DefaultConfig() Config {
 			QueryTimeout:    Duration(30 * time.Second),
 			PreparedStmts:   true,
 		},
-		QueryMetricName:       "sql_query_result",
-		QueryStatusMetricName: "sql_query_status",
-		HTTPCheckTaskTimeout:  Duration(15 * time.Second), // Default timeout for HTTP checks
+		QueryMetricName:            "sql_query_result",
+		QueryStatusMetricName:      "sql_query_status",
+		QuerySkippedRowsMetricName: "sql_query_skipped_rows",
+		HTTPCheckTaskTimeout:       Duration(15 * time.Second), // Default timeout for HTTP checks
+		PoolIdleTimeout:            Duration(5 * time.Minute),
+		MaxPools:                   100,
+		CacheMaxEntries:            1000,
 	}
 
 	return config
@@ -104,5 +231,290 @@ func LoadConfig(configPath string) (Config, error) {
 		return config, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := config.Limits.validate(); err != nil {
+		return config, fmt.Errorf("limits: %w", err)
+	}
+	if config.CacheMaxEntries < 0 {
+		return config, fmt.Errorf("cache_max_entries must not be negative")
+	}
+	if config.MaxPools < 0 {
+		return config, fmt.Errorf("max_pools must not be negative")
+	}
+
+	if err := resolveDataSources(data, &config); err != nil {
+		return config, err
+	}
+
+	if err := resolveEnvRefs(&config); err != nil {
+		return config, err
+	}
+
+	if err := validateQueries(config); err != nil {
+		return config, err
+	}
+
+	if _, err := metric.LabelsFromMap(config.ConstLabels); err != nil {
+		return config, fmt.Errorf("const_labels: %w", err)
+	}
+
 	return config, nil
 }
+
+// ConnOptionsFor returns the connection options to use for the named data source,
+// falling back to the global connection options when the source defines none.
+func (c Config) ConnOptionsFor(sourceName string) ConnectionOptions {
+	if src, ok := c.DataSources[sourceName]; ok && src.ConnOptions != nil {
+		return *src.ConnOptions
+	}
+	return c.ConnOptions
+}
+
+// CacheMaxEntriesFor returns the number of cached outputs kept for the named data source,
+// falling back to the global cache_max_entries when the source sets none.
+func (c Config) CacheMaxEntriesFor(sourceName string) int {
+	if src, ok := c.DataSources[sourceName]; ok && src.CacheMaxEntries > 0 {
+		return src.CacheMaxEntries
+	}
+	return c.CacheMaxEntries
+}
+
+// Redacted returns a copy of the configuration with the secrets masked: the passwords of the
+// data sources and the driver parameters that hold secrets (see redact.IsSecretKey). It is the
+// form in which the configuration may be shown.
+func (c Config) Redacted() Config {
+	r := c
+	r.ConnOptions = c.ConnOptions.redacted()
+	if c.DataSources != nil {
+		r.DataSources = make(map[string]DataSource, len(c.DataSources))
+		for name, src := range c.DataSources {
+			if src.Password != "" {
+				src.Password = redact.Mask
+			}
+			if src.ConnOptions != nil {
+				opts := src.ConnOptions.redacted()
+				src.ConnOptions = &opts
+			}
+			r.DataSources[name] = src
+		}
+	}
+	return r
+}
+
+// resolveDataSources validates the data sources and layers each source's
+// connection_options on top of the global ones, so a source only has to list
+// the fields it wants to change.
+func resolveDataSources(data []byte, config *Config) error {
+	if len(config.DataSources) == 0 {
+		return nil
+	}
+
+	// Re-read the raw per-source options; the typed values have already lost
+	// the information about which fields were actually present.
+	var raw struct {
+		DataSources map[string]struct {
+			ConnOptions json.RawMessage `json:"connection_options"`
+			Limits      json.RawMessage `json:"limits"`
+		} `json:"data_sources"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse data_sources: %w", err)
+	}
+
+	for name, src := range config.DataSources {
+		if src.Type == "" {
+			return fmt.Errorf("data source %q: missing required field: type", name)
+		}
+		if src.Database == "" {
+			return fmt.Errorf("data source %q: missing required field: database", name)
+		}
+		if src.CacheMaxEntries < 0 {
+			return fmt.Errorf("data source %q: cache_max_entries must not be negative", name)
+		}
+
+		opts := config.ConnOptions.clone()
+		if override := raw.DataSources[name].ConnOptions; len(override) > 0 && string(override) != "null" {
+			if err := json.Unmarshal(override, &opts); err != nil {
+				return fmt.Errorf("data source %q: failed to parse connection_options: %w", name, err)
+			}
+		}
+		src.ConnOptions = &opts
+
+		limits := config.Limits
+		if override := raw.DataSources[name].Limits; len(override) > 0 && string(override) != "null" {
+			if err := json.Unmarshal(override, &limits); err != nil {
+				return fmt.Errorf("data source %q: failed to parse limits: %w", name, err)
+			}
+		}
+		if err := limits.validate(); err != nil {
+			return fmt.Errorf("data source %q: limits: %w", name, err)
+		}
+		src.Limits = &limits
+		config.DataSources[name] = src
+	}
+	return nil
+}
+
+// envRefPattern matches references to environment variables, ${env:NAME}.
+var envRefPattern = regexp.MustCompile(`\$\{env:([^}]*)\}`)
+
+// envNamePattern matches valid environment variable names.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// resolveEnvRefs replaces the ${env:NAME} references in the connection details of the data
+// sources and in the driver parameters with the values of the environment variables. Only
+// the variables listed in secret_env can be referenced. This is the only place where the
+// environment is expanded: DSNs, including those built from request parameters, are used
+// literally.
+func resolveEnvRefs(config *Config) error {
+	allowed := make(map[string]bool, len(config.SecretEnv))
+	for _, name := range config.SecretEnv {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("secret_env: invalid environment variable name %q", name)
+		}
+		allowed[name] = true
+	}
+
+	if err := expandDriverParams(config.ConnOptions.DriverParams, allowed); err != nil {
+		return fmt.Errorf("connection_options: %w", err)
+	}
+	for name, src := range config.DataSources {
+		for field, value := range map[string]*string{
+			"host":     &src.Host,
+			"database": &src.Database,
+			"username": &src.Username,
+			"password": &src.Password,
+		} {
+			expanded, err := expandEnvRefs(*value, allowed)
+			if err != nil {
+				return fmt.Errorf("data source %q: %s: %w", name, field, err)
+			}
+			*value = expanded
+		}
+		if src.ConnOptions != nil {
+			if err := expandDriverParams(src.ConnOptions.DriverParams, allowed); err != nil {
+				return fmt.Errorf("data source %q: connection_options: %w", name, err)
+			}
+		}
+		config.DataSources[name] = src
+	}
+	return nil
+}
+
+// expandDriverParams replaces the ${env:NAME} references in the values of the driver parameters.
+func expandDriverParams(driverParams map[string]map[string]string, allowed map[string]bool) error {
+	for driver, params := range driverParams {
+		for key, value := range params {
+			expanded, err := expandEnvRefs(value, allowed)
+			if err != nil {
+				return fmt.Errorf("driver_params %s.%s: %w", driver, key, err)
+			}
+			params[key] = expanded
+		}
+	}
+	return nil
+}
+
+// expandEnvRefs replaces the ${env:NAME} references in s with the values of the environment
+// variables, which must be allowed and set. Errors name the variable but never its value.
+func expandEnvRefs(s string, allowed map[string]bool) (string, error) {
+	var err error
+	expanded := envRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefPattern.FindStringSubmatch(ref)[1]
+		if err != nil {
+			return ref
+		}
+		if !allowed[name] {
+			err = fmt.Errorf("environment variable %q is not listed in secret_env", name)
+			return ref
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// validateQueries checks that every catalog query has SQL, a supported metric type
+// with matching histogram or summary options, valid label names and refers to a known data source.
+func validateQueries(config Config) error {
+	for name, q := range config.Queries {
+		if q.SQL == "" {
+			return fmt.Errorf("query %q: missing required field: sql", name)
+		}
+		metricType, err := metric.ParseMetricType(q.MetricType)
+		if err != nil {
+			return fmt.Errorf("query %q: %w", name, err)
+		}
+		mode, err := metric.ParseMode(q.Mode)
+		if err != nil {
+			return fmt.Errorf("query %q: %w", name, err)
+		}
+		if q.Mode == "" && strings.EqualFold(q.ValueColumn, "none") {
+			mode = metric.ModeInfo
+		}
+		valueColumns, err := metric.ParseValueColumns(q.ValueColumns...)
+		if err != nil {
+			return fmt.Errorf("query %q: %w", name, err)
+		}
+		generator := metric.Generator{Mode: mode, ValueColumns: valueColumns, NameColumn: q.NameColumn, TimestampColumn: q.TimestampColumn,
+			Type: metricType, Buckets: q.Buckets, BucketColumn: q.BucketColumn, SumColumn: q.SumColumn, Quantiles: q.Quantiles}
+		if err := generator.Validate(); err != nil {
+			return fmt.Errorf("query %q: %w", name, err)
+		}
+		if _, err := metric.ParseDuplicatePolicy(q.OnDuplicate); err != nil {
+			return fmt.Errorf("query %q: %w", name, err)
+		}
+		if _, err := metric.ParseNullPolicy(q.NullValue); err != nil {
+			return fmt.Errorf("query %q: %w", name, err)
+		}
+		if q.MinInterval < 0 {
+			return fmt.Errorf("query %q: min_interval must not be negative", name)
+		}
+		if _, err := metric.LabelsFromMap(q.ConstLabels); err != nil {
+			return fmt.Errorf("query %q: const_labels: %w", name, err)
+		}
+		for _, label := range q.Rename {
+			if err := metric.ValidateLabelName(label); err != nil {
+				return fmt.Errorf("query %q: rename: %w", name, err)
+			}
+		}
+		if q.Source != "" {
+			if _, ok := config.DataSources[q.Source]; !ok {
+				return fmt.Errorf("query %q: unknown data source %q", name, q.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of the options that does not share DriverParams maps with the original.
+func (o ConnectionOptions) clone() ConnectionOptions {
+	c := o
+	c.DriverParams = make(map[string]map[string]string, len(o.DriverParams))
+	for driver, params := range o.DriverParams {
+		p := make(map[string]string, len(params))
+		for k, v := range params {
+			p[k] = v
+		}
+		c.DriverParams[driver] = p
+	}
+	return c
+}
+
+// redacted returns a copy of the options with the driver parameters that hold secrets masked.
+func (o ConnectionOptions) redacted() ConnectionOptions {
+	c := o.clone()
+	for _, params := range c.DriverParams {
+		for k := range params {
+			if redact.IsSecretKey(k) {
+				params[k] = redact.Mask
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,278 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"job_runner/config"
+)
+
+// writeConfigFile writes the given JSON to a temporary config file and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigDataSources(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"connection_options": {
+			"max_connections": 10,
+			"query_timeout": "30s",
+			"driver_params": {"postgres": {"sslmode": "disable"}}
+		},
+		"limits": {"max_series": 1000, "on_limit": "fail"},
+		"data_sources": {
+			"prod_orders": {
+				"type": "postgres",
+				"host": "orders-db",
+				"port": 5433,
+				"database": "orders",
+				"username": "exporter",
+				"password": "secret",
+				"connection_options": {
+					"query_timeout": "5s",
+					"driver_params": {"postgres": {"sslmode": "require"}}
+				},
+				"limits": {"max_rows": 50},
+				"cache_max_entries": 20
+			},
+			"local": {
+				"type": "sqlite",
+				"database": "/tmp/local.db"
+			}
+		}
+	}`)
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	orders := cfg.ConnOptionsFor("prod_orders")
+	if orders.QueryTimeout.ToStd() != 5*time.Second {
+		t.Errorf("prod_orders query_timeout = %v, want 5s", orders.QueryTimeout.ToStd())
+	}
+	if orders.MaxConns != 10 {
+		t.Errorf("prod_orders max_connections = %d, want 10 (inherited from global)", orders.MaxConns)
+	}
+	if got := orders.DriverParams["postgres"]["sslmode"]; got != "require" {
+		t.Errorf("prod_orders sslmode = %q, want %q", got, "require")
+	}
+	if got := cfg.ConnOptions.DriverParams["postgres"]["sslmode"]; got != "disable" {
+		t.Errorf("global sslmode = %q, want %q (must not be changed by a source override)", got, "disable")
+	}
+
+	local := cfg.ConnOptionsFor("local")
+	if local.QueryTimeout.ToStd() != 30*time.Second {
+		t.Errorf("local query_timeout = %v, want 30s", local.QueryTimeout.ToStd())
+	}
+
+	if got := cfg.ConnOptionsFor("missing").MaxConns; got != 10 {
+		t.Errorf("unknown source max_connections = %d, want global value 10", got)
+	}
+
+	wantOrders := config.Limits{MaxSeries: 1000, MaxRows: 50, OnLimit: config.OnLimitFail}
+	if got := cfg.DataSources["prod_orders"].Limits; got == nil || *got != wantOrders {
+		t.Errorf("prod_orders limits = %+v, want %+v", got, wantOrders)
+	}
+	if got := cfg.DataSources["local"].Limits; got == nil || *got != cfg.Limits {
+		t.Errorf("local limits = %+v, want global limits %+v", got, cfg.Limits)
+	}
+
+	if got := cfg.CacheMaxEntriesFor("prod_orders"); got != 20 {
+		t.Errorf("prod_orders cache_max_entries = %d, want 20", got)
+	}
+	if got := cfg.CacheMaxEntriesFor("local"); got != 1000 {
+		t.Errorf("local cache_max_entries = %d, want global default 1000", got)
+	}
+}
+
+func TestLoadConfigDataSourceValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "Missing type",
+			content: `{"data_sources": {"broken": {"database": "db"}}}`,
+			wantErr: `data source "broken": missing required field: type`,
+		},
+		{
+			name:    "Missing database",
+			content: `{"data_sources": {"broken": {"type": "postgres", "host": "h"}}}`,
+			wantErr: `data source "broken": missing required field: database`,
+		},
+		{
+			name:    "Query without SQL",
+			content: `{"queries": {"table_sizes": {"value_column": "size"}}}`,
+			wantErr: `query "table_sizes": missing required field: sql`,
+		},
+		{
+			name:    "Query with unknown source",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "source": "missing"}}}`,
+			wantErr: `query "table_sizes": unknown data source "missing"`,
+		},
+		{
+			name:    "Query with unsupported metric type",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "metric_type": "meter"}}}`,
+			wantErr: `query "table_sizes": unsupported metric type "meter"`,
+		},
+		{
+			name:    "Invalid constant label name",
+			content: `{"const_labels": {"bad-name": "x"}}`,
+			wantErr: `const_labels: invalid label name "bad-name"`,
+		},
+		{
+			name:    "Query with invalid rename",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "rename": {"name": "__name__"}}}}`,
+			wantErr: `query "table_sizes": rename: label name "__name__" is reserved`,
+		},
+		{
+			name:    "Query with unsupported duplicate policy",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "on_duplicate": "avg"}}}`,
+			wantErr: `query "table_sizes": unsupported duplicate policy "avg"`,
+		},
+		{
+			name:    "Query with unsupported mode",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "mode": "table"}}}`,
+			wantErr: `query "table_sizes": unsupported mode "table"`,
+		},
+		{
+			name:    "Info query with value columns",
+			content: `{"queries": {"settings": {"sql": "SELECT name, setting FROM settings", "value_column": "none", "value_columns": ["setting"]}}}`,
+			wantErr: `query "settings": value columns cannot be used in info mode`,
+		},
+		{
+			name:    "Query with unsupported null value policy",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "null_value": "drop"}}}`,
+			wantErr: `query "table_sizes": unsupported null value policy "drop"`,
+		},
+		{
+			name:    "Unsupported limit policy",
+			content: `{"limits": {"max_series": 10, "on_limit": "drop"}}`,
+			wantErr: `limits: unsupported on_limit policy "drop"`,
+		},
+		{
+			name:    "Negative source limit",
+			content: `{"data_sources": {"local": {"type": "sqlite", "database": "/tmp/local.db", "limits": {"max_rows": -1}}}}`,
+			wantErr: `data source "local": limits: limits must not be negative`,
+		},
+		{
+			name:    "Negative source cache size",
+			content: `{"data_sources": {"local": {"type": "sqlite", "database": "/tmp/local.db", "cache_max_entries": -1}}}`,
+			wantErr: `data source "local": cache_max_entries must not be negative`,
+		},
+		{
+			name:    "Query with negative min interval",
+			content: `{"queries": {"table_sizes": {"sql": "SELECT 1 AS value", "min_interval": "-1m"}}}`,
+			wantErr: `query "table_sizes": min_interval must not be negative`,
+		},
+		{
+			name:    "Histogram without buckets",
+			content: `{"queries": {"latency": {"sql": "SELECT 1 AS value", "metric_type": "histogram"}}}`,
+			wantErr: `query "latency": histogram requires a bucket column or buckets`,
+		},
+		{
+			name:    "Environment variable not in secret_env",
+			content: `{"data_sources": {"orders": {"type": "postgres", "database": "orders", "password": "${env:HOME}"}}}`,
+			wantErr: `data source "orders": password: environment variable "HOME" is not listed in secret_env`,
+		},
+		{
+			name:    "Unset environment variable",
+			content: `{"secret_env": ["JOB_RUNNER_TEST_UNSET"], "connection_options": {"driver_params": {"sqlserver": {"password": "${env:JOB_RUNNER_TEST_UNSET}"}}}}`,
+			wantErr: `connection_options: driver_params sqlserver.password: environment variable "JOB_RUNNER_TEST_UNSET" is not set`,
+		},
+		{
+			name:    "Invalid secret_env name",
+			content: `{"secret_env": ["DB-PASSWORD"]}`,
+			wantErr: `secret_env: invalid environment variable name "DB-PASSWORD"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := config.LoadConfig(writeConfigFile(t, tt.content))
+			if err == nil {
+				t.Fatalf("LoadConfig() expected error containing %q, got nil", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %q, want it to contain %q", err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvRefs(t *testing.T) {
+	t.Setenv("JOB_RUNNER_TEST_PASSWORD", "s3cret")
+	t.Setenv("JOB_RUNNER_TEST_HOST", "orders-db")
+	t.Setenv("JOB_RUNNER_TEST_OTHER", "other")
+	path := writeConfigFile(t, `{
+		"secret_env": ["JOB_RUNNER_TEST_PASSWORD", "JOB_RUNNER_TEST_HOST"],
+		"connection_options": {"driver_params": {"sqlserver": {"password": "${env:JOB_RUNNER_TEST_PASSWORD}"}}},
+		"data_sources": {
+			"orders": {
+				"type": "postgres",
+				"host": "${env:JOB_RUNNER_TEST_HOST}.internal",
+				"database": "orders",
+				"username": "$JOB_RUNNER_TEST_OTHER",
+				"password": "${env:JOB_RUNNER_TEST_PASSWORD}"
+			}
+		}
+	}`)
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	orders := cfg.DataSources["orders"]
+	if orders.Host != "orders-db.internal" || orders.Password != "s3cret" {
+		t.Errorf("orders host = %q, password = %q, want the references resolved", orders.Host, orders.Password)
+	}
+	if orders.Username != "$JOB_RUNNER_TEST_OTHER" {
+		t.Errorf("orders username = %q, want it unchanged: only ${env:NAME} references are resolved", orders.Username)
+	}
+	if got := cfg.ConnOptions.DriverParams["sqlserver"]["password"]; got != "s3cret" {
+		t.Errorf("sqlserver password = %q, want the reference resolved", got)
+	}
+	if got := orders.ConnOptions.DriverParams["sqlserver"]["password"]; got != "s3cret" {
+		t.Errorf("orders sqlserver password = %q, want the reference resolved", got)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.ConnOptions.DriverParams = map[string]map[string]string{"sqlserver": {"password": "s3cret", "encrypt": "true"}}
+	sourceOpts := cfg.ConnOptions
+	sourceOpts.DriverParams = map[string]map[string]string{"postgres": {"sslpassword": "s3cret"}}
+	cfg.DataSources = map[string]config.DataSource{
+		"orders": {Type: "postgres", Database: "orders", Username: "exporter", Password: "s3cret", ConnOptions: &sourceOpts},
+		"local":  {Type: "sqlite", Database: "/tmp/local.db"},
+	}
+
+	redacted := cfg.Redacted()
+	if got := redacted.DataSources["orders"].Password; got != "xxxxx" {
+		t.Errorf("orders password = %q, want it masked", got)
+	}
+	if got := redacted.DataSources["local"].Password; got != "" {
+		t.Errorf("local password = %q, want it empty", got)
+	}
+	if got := redacted.ConnOptions.DriverParams["sqlserver"]; got["password"] != "xxxxx" || got["encrypt"] != "true" {
+		t.Errorf("sqlserver driver params = %v, want only the password masked", got)
+	}
+	if got := redacted.DataSources["orders"].ConnOptions.DriverParams["postgres"]["sslpassword"]; got != "xxxxx" {
+		t.Errorf("orders sslpassword = %q, want it masked", got)
+	}
+
+	// The original configuration is unchanged
+	if cfg.DataSources["orders"].Password != "s3cret" || cfg.ConnOptions.DriverParams["sqlserver"]["password"] != "s3cret" ||
+		sourceOpts.DriverParams["postgres"]["sslpassword"] != "s3cret" {
+		t.Errorf("Redacted() modified the original configuration")
+	}
+}
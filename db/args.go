@@ -0,0 +1,161 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported argument types for ConvertArg.
+const (
+	ArgTypeString = "string"
+	ArgTypeInt    = "int"
+	ArgTypeFloat  = "float"
+	ArgTypeTime   = "time"
+)
+
+// argTimeLayouts are the layouts accepted for time arguments, tried in order.
+var argTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ConvertArg converts a request-supplied argument value to the Go type named by argType,
+// so that it is bound with the right type. An empty argType means string.
+func ConvertArg(value, argType string) (any, error) {
+	switch strings.ToLower(argType) {
+	case "", ArgTypeString:
+		return value, nil
+	case ArgTypeInt:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int value %q", value)
+		}
+		return i, nil
+	case ArgTypeFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float value %q", value)
+		}
+		return f, nil
+	case ArgTypeTime:
+		for _, layout := range argTimeLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, nil
+			}
+		}
+		if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(secs, 0).UTC(), nil
+		}
+		return nil, fmt.Errorf("invalid time value %q (expected RFC 3339, a date or unix seconds)", value)
+	default:
+		return nil, fmt.Errorf("unsupported argument type %q (supported: string, int, float, time)", argType)
+	}
+}
+
+// BindArgs adapts a query and its arguments to the placeholder style of the driver.
+// Positional arguments are passed through unchanged and must use the driver's own
+// placeholders ($1 for PostgreSQL, :1 for Oracle, @p1 for SQL Server, ? for SQLite).
+// Named arguments (sql.NamedArg) are referenced as :name in the query and are
+// rewritten to whatever the driver understands.
+func BindArgs(driverName, query string, args []any) (string, []any, error) {
+	var positional []any
+	named := make(map[string]any)
+	for _, arg := range args {
+		if na, ok := arg.(sql.NamedArg); ok {
+			named[na.Name] = na.Value
+			continue
+		}
+		positional = append(positional, arg)
+	}
+	if len(named) == 0 {
+		return query, args, nil
+	}
+
+	// Collect the :name references, in order of first appearance.
+	type reference struct {
+		start, end int
+		name       string
+	}
+	var refs []reference
+	forEachCodeSpan(query, func(start, end int) {
+		code := query[start:end]
+		for i := 0; i < len(code); i++ {
+			if code[i] != ':' {
+				continue
+			}
+			if i+1 < len(code) && code[i+1] == ':' { // PostgreSQL cast (::type)
+				i++
+				continue
+			}
+			if i > 0 && (code[i-1] == '_' || isLetter(code[i-1]) || isDigit(code[i-1])) {
+				continue
+			}
+			if nameEnd := identifierEnd(code, i+1); nameEnd > i+1 {
+				refs = append(refs, reference{start: start + i, end: start + nameEnd, name: code[i+1 : nameEnd]})
+				i = nameEnd - 1
+			}
+		}
+	})
+
+	referenced := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		if _, ok := named[ref.name]; !ok {
+			return "", nil, fmt.Errorf("no value for named parameter :%s", ref.name)
+		}
+		referenced[ref.name] = true
+	}
+	var unused []string
+	for name := range named {
+		if !referenced[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return "", nil, fmt.Errorf("named parameters not referenced by the query: %s", strings.Join(unused, ", "))
+	}
+
+	switch driverName {
+	case "postgres", "pgx":
+		// Neither lib/pq nor pgx supports named arguments; number them after the positional ones.
+		numbers := make(map[string]int)
+		bound := append([]any(nil), positional...)
+		var b strings.Builder
+		last := 0
+		for _, ref := range refs {
+			n, ok := numbers[ref.name]
+			if !ok {
+				bound = append(bound, named[ref.name])
+				n = len(bound)
+				numbers[ref.name] = n
+			}
+			b.WriteString(query[last:ref.start])
+			b.WriteString("$" + strconv.Itoa(n))
+			last = ref.end
+		}
+		b.WriteString(query[last:])
+		return b.String(), bound, nil
+	case "sqlserver", "azuresql":
+		// go-mssqldb binds sql.NamedArg to @name.
+		var b strings.Builder
+		last := 0
+		for _, ref := range refs {
+			b.WriteString(query[last:ref.start])
+			b.WriteString("@" + ref.name)
+			last = ref.end
+		}
+		b.WriteString(query[last:])
+		return b.String(), args, nil
+	case "oracle", "sqlite":
+		// Both drivers bind sql.NamedArg to :name natively.
+		return query, args, nil
+	default:
+		return "", nil, fmt.Errorf("named parameters are not supported for driver %s", driverName)
+	}
+}
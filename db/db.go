@@ -6,11 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
 
 	"job_runner/config"
 	dberrors "job_runner/errors"
+	"job_runner/redact"
 
 	"github.com/xo/dburl"
 
@@ -25,23 +26,26 @@ import (
 // Connection represents a database connection and its associated settings
 type Connection struct {
 	DB     *sql.DB
+	Driver string // Name of the database/sql driver, e.g. "postgres", "sqlite"
 	Config config.ConnectionOptions
 }
 
-// SafeParse wraps dburl.Parse method to prevent leaking credentials in error messages
+// SafeParse wraps dburl.Parse method to prevent leaking credentials in error messages.
+// The DSN is used literally: it may be built from request parameters, so environment
+// variables are not expanded (see config.Config.SecretEnv for references in the config).
 func SafeParse(rawURL string) (*dburl.URL, error) {
-	expandedURL := os.ExpandEnv(rawURL)
-	parsed, err := dburl.Parse(expandedURL)
+	parsed, err := dburl.Parse(rawURL)
 	if err != nil {
 		if uerr := new(url.Error); errors.As(err, &uerr) {
 			return nil, fmt.Errorf("invalid DSN (underlying error: %w)", uerr.Err)
 		}
-		return nil, fmt.Errorf("invalid DSN (dburl.Parse error: %w)", err)
+		return nil, fmt.Errorf("invalid DSN (dburl.Parse error: %w)", redact.Error(err))
 	}
 	return parsed, nil
 }
 
-// BuildDSN constructs a data source name (connection string) based on the database type and parameters
+// BuildDSN constructs a data source name (connection string) based on the database type and parameters.
+// The credentials and the database name are escaped, so they may contain any character.
 func BuildDSN(dbType, username, password, host, port, database string) (string, error) {
 	switch strings.ToLower(dbType) {
 	case "sqlite", "sqlite3":
@@ -55,25 +59,25 @@ func BuildDSN(dbType, username, password, host, port, database string) (string,
 		if port != "" {
 			portVal = port
 		}
-		return fmt.Sprintf("postgres://%s:%s@%s:%s/%s", username, password, host, portVal, database), nil
+		return buildURL("postgres", username, password, host, portVal, database, nil), nil
 	case "oracle":
 		portVal := "1521"
 		if port != "" {
 			portVal = port
 		}
-		return fmt.Sprintf("oracle://%s:%s@%s:%s/%s", username, password, host, portVal, database), nil
+		return buildURL("oracle", username, password, host, portVal, database, nil), nil
 	case "sqlserver", "mssql":
 		portVal := "1433"
 		if port != "" {
 			portVal = port
 		}
-		return fmt.Sprintf("sqlserver://%s:%s@%s:%s?database=%s", username, password, host, portVal, database), nil
+		return buildURL("sqlserver", username, password, host, portVal, "", url.Values{"database": {database}}), nil
 	default:
 		// Use dburl to build DSN for other types
-		dsn := fmt.Sprintf("%s://%s:%s@%s:%s/%s", dbType, username, password, host, port, database)
+		dsn := buildURL(dbType, username, password, host, port, database, nil)
 		u, err := dburl.Parse(dsn) // dburl.Parse, not SafeParse here, as we construct it carefully
 		if err != nil {
-			return "", fmt.Errorf("failed to parse constructed DSN: %w", err)
+			return "", fmt.Errorf("failed to parse constructed DSN: %w", redact.Error(err, password))
 		}
 		// Ensure the scheme is set correctly for the driver if dburl didn't infer it as expected
 		// (though for fully qualified DSNs like above, dburl should get it right)
@@ -87,9 +91,42 @@ func BuildDSN(dbType, username, password, host, port, database string) (string,
 	}
 }
 
+// buildURL returns a URL-style DSN. The user info, the database (the path, if not empty) and
+// the query are escaped, so a password such as "p@ss/w#rd" cannot change the host or the path.
+func buildURL(scheme, username, password, host, port, database string, query url.Values) string {
+	u := url.URL{
+		Scheme:   scheme,
+		User:     url.UserPassword(username, password),
+		Host:     host + ":" + port,
+		RawQuery: query.Encode(),
+	}
+	if database != "" {
+		u.Path = "/" + database
+	}
+	return u.String()
+}
+
+// BuildSourceDSN constructs the data source name for a data source defined in the config.
+func BuildSourceDSN(src config.DataSource) (string, error) {
+	port := ""
+	if src.Port != 0 {
+		port = strconv.Itoa(src.Port)
+	}
+	return BuildDSN(src.Type, src.Username, src.Password, src.Host, port, src.Database)
+}
+
 // Open opens a database connection with the specified parameters
 func Open(ctx context.Context, dsn string, connOpts config.ConnectionOptions) (*Connection, error) {
-	originalDSN := dsn
+	driverToUse, dsnForSqlOpen, err := normalizeDSN(dsn, connOpts)
+	if err != nil {
+		return nil, err
+	}
+	return openNormalized(ctx, driverToUse, dsnForSqlOpen, connOpts)
+}
+
+// normalizeDSN resolves the driver name and the DSN to hand to sql.Open,
+// with the driver-specific parameters from connOpts merged in.
+func normalizeDSN(dsn string, connOpts config.ConnectionOptions) (string, string, error) {
 	// Check if the DSN is a plain path that might be for SQLite.
 	// dburl.Parse might not recognize plain paths as SQLite without a scheme.
 	if !strings.Contains(dsn, "://") &&
@@ -104,15 +141,16 @@ func Open(ctx context.Context, dsn string, connOpts config.ConnectionOptions) (*
 		dsn = "sqlite://" + dsn
 	}
 
-	parsedURL, err := SafeParse(dsn) // SafeParse calls os.ExpandEnv then dburl.Parse
+	parsedURL, err := SafeParse(dsn)
 	if err != nil {
-		return nil, dberrors.NewDBError(fmt.Sprintf("failed to parse DSN '%s' (original DSN was '%s'): %v", dsn, originalDSN, err))
+		// The DSN is not quoted: it cannot be parsed, so its password could not be masked
+		return "", "", dberrors.WrapDBError(err, "failed to parse DSN")
 	}
 
 	// Get current query values from the parsed DSN
 	queryValues, qErr := url.ParseQuery(parsedURL.RawQuery)
 	if qErr != nil {
-		return nil, dberrors.NewDBError(fmt.Sprintf("failed to parse DSN query parameters from '%s' (in DSN '%s'): %v", parsedURL.RawQuery, dsn, qErr))
+		return "", "", dberrors.WrapDBError(redact.Error(qErr, redact.SecretsOf(dsn)...), fmt.Sprintf("failed to parse DSN query parameters (in DSN '%s')", redact.DSN(dsn)))
 	}
 
 	// Apply driver-specific parameters from config, potentially overriding or adding to existing ones
@@ -169,9 +207,16 @@ func Open(ctx context.Context, dsn string, connOpts config.ConnectionOptions) (*
 		dsnForSqlOpen = parsedURL.String()
 	}
 
+	return driverToUse, dsnForSqlOpen, nil
+}
+
+// openNormalized opens and configures a database handle for a DSN returned by normalizeDSN.
+// The DSN is redacted in errors, and so are the errors of the driver, which may quote it.
+func openNormalized(ctx context.Context, driverToUse, dsnForSqlOpen string, connOpts config.ConnectionOptions) (*Connection, error) {
+	secrets := redact.SecretsOf(dsnForSqlOpen)
 	db, sqlOpenErr := sql.Open(driverToUse, dsnForSqlOpen)
 	if sqlOpenErr != nil {
-		return nil, dberrors.NewDBError(fmt.Sprintf("failed to open database connection (driver: %s, dsn: '%s'): %v", driverToUse, dsnForSqlOpen, sqlOpenErr))
+		return nil, dberrors.WrapDBError(redact.Error(sqlOpenErr, secrets...), fmt.Sprintf("failed to open database connection (driver: %s, dsn: '%s')", driverToUse, redact.DSN(dsnForSqlOpen)))
 	}
 
 	// Configure connection pool
@@ -186,12 +231,13 @@ func Open(ctx context.Context, dsn string, connOpts config.ConnectionOptions) (*
 
 		if pingErr := db.PingContext(pingCtx); pingErr != nil {
 			db.Close() // Close the connection if ping fails
-			return nil, dberrors.NewDBError(fmt.Sprintf("ping failed (driver: %s, dsn: '%s'): %v", driverToUse, dsnForSqlOpen, pingErr))
+			return nil, dberrors.WrapDBError(redact.Error(pingErr, secrets...), fmt.Sprintf("ping failed (driver: %s, dsn: '%s')", driverToUse, redact.DSN(dsnForSqlOpen)))
 		}
 	}
 
 	return &Connection{
 		DB:     db,
+		Driver: driverToUse,
 		Config: connOpts,
 	}, nil
 }
@@ -204,28 +250,39 @@ func (c *Connection) Close() error {
 	return nil
 }
 
-// ExecuteQuery runs the SQL query and returns the results
-func (c *Connection) ExecuteQuery(ctx context.Context, query string) (*sql.Rows, error) {
+// ExecuteQuery runs the SQL query with the given bind arguments and returns the results.
+// Arguments are passed to the driver as real bind parameters; see BindArgs for the placeholder syntax.
+func (c *Connection) ExecuteQuery(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
 	if c.DB == nil {
 		return nil, dberrors.NewDBError("database connection is nil")
 	}
 
-	if c.Config.PreparedStmts {
-		stmt, err := c.DB.PrepareContext(ctx, query) // Use original context
+	query, args, err := BindArgs(c.Driver, query, args)
+	if err != nil {
+		return nil, dberrors.WrapQueryError(err, "bind arguments failed")
+	}
+
+	return c.queryWith(ctx, c.DB, query, args, c.Config.PreparedStmts)
+}
+
+// queryWith runs an already bound query on q, using a prepared statement if prepare is set.
+func (c *Connection) queryWith(ctx context.Context, q queryer, query string, args []any, prepare bool) (*sql.Rows, error) {
+	if prepare {
+		stmt, err := q.PrepareContext(ctx, query) // Use original context
 		if err != nil {
-			return nil, dberrors.NewQueryError(fmt.Sprintf("prepare query failed: %v", err))
+			return nil, dberrors.WrapQueryError(err, "prepare query failed")
 		}
 		defer stmt.Close()
-		rows, err := stmt.QueryContext(ctx) // Use original context
+		rows, err := stmt.QueryContext(ctx, args...) // Use original context
 		if err != nil {
-			return nil, dberrors.NewQueryError(fmt.Sprintf("execute prepared query failed: %v", err))
+			return nil, dberrors.WrapQueryError(err, "execute prepared query failed")
 		}
 		return rows, nil
 	}
 
-	rows, err := c.DB.QueryContext(ctx, query) // Use original context
+	rows, err := q.QueryContext(ctx, query, args...) // Use original context
 	if err != nil {
-		return nil, dberrors.NewQueryError(fmt.Sprintf("execute query failed: %v", err))
+		return nil, dberrors.WrapQueryError(err, "execute query failed")
 	}
 	return rows, nil
 }
@@ -2,8 +2,15 @@ package db_test
 
 import (
 	"context"
+	"database/sql"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"job_runner/config"
 	"job_runner/db"
 	"job_runner/tests"
 )
@@ -99,3 +106,408 @@ func TestBuildDSN(t *testing.T) {
 		})
 	}
 }
+
+func TestSafeParseUsesDSNLiterally(t *testing.T) {
+	t.Setenv("JOB_RUNNER_TEST_SECRET", "s3cret")
+
+	// Request parameters end up in the DSN as they are
+	dsn, err := db.BuildDSN("pg", "app", "$JOB_RUNNER_TEST_SECRET", "db", "5432", "${env:JOB_RUNNER_TEST_SECRET}")
+	if err != nil {
+		t.Fatalf("BuildDSN() error = %v", err)
+	}
+	u, err := db.SafeParse(dsn)
+	if err != nil {
+		t.Fatalf("SafeParse(%q) error = %v", dsn, err)
+	}
+	if got, _ := u.User.Password(); got != "$JOB_RUNNER_TEST_SECRET" {
+		t.Errorf("SafeParse(%q) password = %q, want it unexpanded", dsn, got)
+	}
+	if u.Path != "/${env:JOB_RUNNER_TEST_SECRET}" {
+		t.Errorf("SafeParse(%q) path = %q, want it unexpanded", dsn, u.Path)
+	}
+}
+
+func TestOpenRedactsCredentials(t *testing.T) {
+	// Every type is opened against a closed port (or a missing directory for SQLite), so that
+	// the DSN ends up in the error, along with whatever the driver reports.
+	for _, password := range []string{"s3cretPw", "pa ss", `s3'cr"et`} {
+		connOpts := config.DefaultConfig().ConnOptions
+		connOpts.ConnectTimeout = config.Duration(2 * time.Second)
+		connOpts.DriverParams = map[string]map[string]string{"sqlserver": {"password": password}}
+
+		for _, dbType := range []string{"pg", "postgres", "postgresql", "oracle", "sqlserver", "mssql", "sqlite", "mysql", "cockroachdb"} {
+			t.Run(dbType+"/"+password, func(t *testing.T) {
+				database := "app"
+				if dbType == "sqlite" {
+					database = "/nonexistent/app.db"
+				}
+				dsn, err := db.BuildDSN(dbType, "app", password, "127.0.0.1", "1", database)
+				if err != nil {
+					assertNoSecret(t, err, password)
+					return
+				}
+
+				conn, err := db.Open(context.Background(), dsn, connOpts)
+				if err == nil {
+					conn.Close()
+					t.Fatalf("Open(%s) succeeded, want an error", dbType)
+				}
+				assertNoSecret(t, err, password)
+				// A DSN that cannot be parsed, such as one with a space in the password, is not quoted at all
+				if _, parseErr := db.SafeParse(dsn); parseErr == nil && dbType != "sqlite" && !strings.Contains(err.Error(), "app:xxxxx@") {
+					t.Errorf("Open() error does not show the redacted DSN: %v", err)
+				}
+			})
+		}
+	}
+
+	// A DSN that cannot be parsed is not quoted
+	_, err := db.Open(context.Background(), "postgres://app:pa ss@127.0.0.1:1/app", config.DefaultConfig().ConnOptions)
+	if err == nil {
+		t.Fatalf("Open() succeeded, want an error")
+	}
+	assertNoSecret(t, err, "pa ss")
+}
+
+// assertNoSecret fails the test if the message of err contains the secret, as it is or
+// escaped for a URL.
+func assertNoSecret(t *testing.T, err error, secret string) {
+	t.Helper()
+	for _, form := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+		if strings.Contains(err.Error(), form) {
+			t.Errorf("error contains the secret %q: %v", secret, err)
+		}
+	}
+}
+
+func TestBuildDSNEscapesCredentials(t *testing.T) {
+	const (
+		username = "app user"
+		password = "p@ss/w#rd?a%b c:d"
+		database = "my db?x#y"
+	)
+	for _, dbType := range []string{"pg", "oracle", "sqlserver", "mysql"} {
+		t.Run(dbType, func(t *testing.T) {
+			dsn, err := db.BuildDSN(dbType, username, password, "db.internal", "1234", database)
+			if err != nil {
+				t.Fatalf("BuildDSN() error = %v", err)
+			}
+			u, err := db.SafeParse(dsn)
+			if err != nil {
+				t.Fatalf("SafeParse(%q) error = %v", dsn, err)
+			}
+			if got, _ := u.User.Password(); got != password || u.User.Username() != username {
+				t.Errorf("credentials = %q/%q, want %q/%q", u.User.Username(), got, username, password)
+			}
+			if u.Hostname() != "db.internal" || u.Port() != "1234" {
+				t.Errorf("host = %q, want db.internal:1234", u.Host)
+			}
+			gotDatabase := strings.TrimPrefix(u.Path, "/")
+			if dbType == "sqlserver" {
+				gotDatabase = u.Query().Get("database")
+			}
+			if gotDatabase != database {
+				t.Errorf("database = %q, want %q", gotDatabase, database)
+			}
+		})
+	}
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	_, testDBPath, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	pool := db.NewPool(0, 0)
+	defer pool.Close()
+
+	ctx := context.Background()
+	opts := config.DefaultConfig().ConnOptions
+
+	first, err := pool.Get(ctx, testDBPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	second, err := pool.Get(ctx, testDBPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	if first.DB != second.DB {
+		t.Errorf("Expected the same *sql.DB for the same DSN and options")
+	}
+	if pool.Len() != 1 {
+		t.Errorf("Expected 1 pool, got %d", pool.Len())
+	}
+
+	// Changed connection options (e.g. after /reload) must rebuild the pool.
+	opts.MaxConns = opts.MaxConns + 1
+	third, err := pool.Get(ctx, testDBPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	if third.DB == first.DB {
+		t.Errorf("Expected a new *sql.DB after the connection options changed")
+	}
+	if pool.Len() != 1 {
+		t.Errorf("Expected the old pool to be replaced, got %d pools", pool.Len())
+	}
+}
+
+func TestPoolEvictsIdleConnections(t *testing.T) {
+	_, testDBPath, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	pool := db.NewPool(50*time.Millisecond, 0)
+	defer pool.Close()
+
+	if _, err := pool.Get(context.Background(), testDBPath, config.DefaultConfig().ConnOptions); err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool.Len() != 0 {
+		t.Errorf("Expected the idle pool to be evicted, got %d pools", pool.Len())
+	}
+}
+
+func TestPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	pool := db.NewPool(0, 2)
+	defer pool.Close()
+
+	ctx := context.Background()
+	opts := config.DefaultConfig().ConnOptions
+	dir := t.TempDir()
+	get := func(name string) *db.Connection {
+		t.Helper()
+		conn, err := pool.Get(ctx, filepath.Join(dir, name), opts)
+		if err != nil {
+			t.Fatalf("Failed to get connection: %v", err)
+		}
+		return conn
+	}
+
+	first := get("first.db")
+	second := get("second.db")
+	time.Sleep(time.Millisecond)
+	get("first.db") // first is now used more recently than second
+	get("third.db")
+
+	if pool.Len() != 2 {
+		t.Errorf("Expected 2 pools, got %d", pool.Len())
+	}
+	if get("first.db").DB != first.DB {
+		t.Errorf("Expected the recently used pool to be kept")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for second.DB.Ping() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if second.DB.Ping() == nil {
+		t.Errorf("Expected the least recently used pool to be closed")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	_, testDBPath, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	pool := db.NewPool(time.Minute, 0)
+	ctx := context.Background()
+	opts := config.DefaultConfig().ConnOptions
+
+	conn, err := pool.Get(ctx, testDBPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Failed to close pool: %v", err)
+	}
+	if err := conn.DB.Ping(); err == nil {
+		t.Errorf("Expected the pooled connection to be closed")
+	}
+	if _, err := pool.Get(ctx, testDBPath, opts); err == nil {
+		t.Errorf("Expected an error when using a closed pool")
+	}
+}
+
+func TestBindArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		driver    string
+		query     string
+		args      []any
+		wantQuery string
+		wantArgs  []any
+		wantErr   string
+	}{
+		{
+			name:      "Positional only is unchanged",
+			driver:    "postgres",
+			query:     "SELECT * FROM t WHERE a = $1",
+			args:      []any{int64(1)},
+			wantQuery: "SELECT * FROM t WHERE a = $1",
+			wantArgs:  []any{int64(1)},
+		},
+		{
+			name:      "PostgreSQL named arguments are numbered",
+			driver:    "postgres",
+			query:     "SELECT x::text, ':skip' FROM t WHERE a = $1 AND b = :tenant -- :comment\nAND c = :tenant OR d = :id",
+			args:      []any{"first", sql.Named("tenant", "acme"), sql.Named("id", int64(7))},
+			wantQuery: "SELECT x::text, ':skip' FROM t WHERE a = $1 AND b = $2 -- :comment\nAND c = $2 OR d = $3",
+			wantArgs:  []any{"first", "acme", int64(7)},
+		},
+		{
+			name:      "SQL Server named arguments use @name",
+			driver:    "sqlserver",
+			query:     "SELECT * FROM t WHERE b = :tenant",
+			args:      []any{sql.Named("tenant", "acme")},
+			wantQuery: "SELECT * FROM t WHERE b = @tenant",
+			wantArgs:  []any{sql.Named("tenant", "acme")},
+		},
+		{
+			name:      "SQLite named arguments are passed through",
+			driver:    "sqlite",
+			query:     "SELECT * FROM t WHERE b = :tenant",
+			args:      []any{sql.Named("tenant", "acme")},
+			wantQuery: "SELECT * FROM t WHERE b = :tenant",
+			wantArgs:  []any{sql.Named("tenant", "acme")},
+		},
+		{
+			name:    "Missing named value",
+			driver:  "postgres",
+			query:   "SELECT * FROM t WHERE b = :tenant AND c = :other",
+			args:    []any{sql.Named("tenant", "acme")},
+			wantErr: "no value for named parameter :other",
+		},
+		{
+			name:    "Unreferenced named value",
+			driver:  "oracle",
+			query:   "SELECT * FROM t WHERE b = :tenant",
+			args:    []any{sql.Named("tenant", "acme"), sql.Named("typo", 1)},
+			wantErr: "named parameters not referenced by the query: typo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := db.BindArgs(tt.driver, tt.query, tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("BindArgs() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BindArgs() unexpected error: %v", err)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("BindArgs() query = %q, want %q", query, tt.wantQuery)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("BindArgs() args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestExecuteQueryWithArgs(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	rows, err := conn.ExecuteQuery(ctx, "SELECT name FROM tables WHERE rows > ? AND name <> :excluded ORDER BY name",
+		int64(1000), sql.Named("excluded", "users"))
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("Failed to scan row: %v", err)
+		}
+		names = append(names, name)
+	}
+	if want := []string{"orders"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+}
+
+func TestCheckReadOnlyStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{name: "Select", query: "SELECT name, rows FROM tables"},
+		{name: "With", query: "  -- leading comment\n WITH t AS (SELECT 1 AS value) SELECT value FROM t;"},
+		{name: "Keywords inside literals", query: "SELECT 'DELETE FROM tables; DROP TABLE x' AS value, \"insert\" FROM t /* UPDATE */"},
+		{name: "Delete", query: "DELETE FROM tables", wantErr: "only SELECT and WITH statements are allowed, got DELETE"},
+		{name: "Stacked statements", query: "SELECT 1; DROP TABLE tables", wantErr: "multiple statements are not allowed"},
+		{name: "Data-modifying CTE", query: "WITH d AS (DELETE FROM tables RETURNING *) SELECT * FROM d", wantErr: "statement contains disallowed keyword DELETE"},
+		{name: "Select into", query: "SELECT * INTO backup FROM tables", wantErr: "statement contains disallowed keyword INTO"},
+		{name: "Empty", query: " /* nothing */ ", wantErr: "empty statement"},
+		{name: "Case expression", query: "SELECT CASE WHEN n > 0 THEN 'a' ELSE 'b' END AS sign FROM t"},
+		{name: "Hierarchical query", query: "SELECT id FROM t START WITH parent IS NULL CONNECT BY PRIOR id = parent"},
+		{name: "Dollar in identifier", query: "SELECT sid FROM v$session"},
+		{name: "Escape string", query: `SELECT E'it\'s; DELETE' AS value`},
+		{name: "Escape string bypass", query: `SELECT E'\'' ; COMMIT; DELETE FROM t; --'`, wantErr: "multiple statements are not allowed"},
+		{name: "Dollar quote bypass", query: "SELECT x$a$ FROM t; COMMIT; DELETE FROM t; SELECT 1 AS y$a$", wantErr: "multiple statements are not allowed"},
+		{name: "Transaction control", query: "SELECT 1 COMMIT", wantErr: "statement contains disallowed keyword COMMIT"},
+		{name: "Unmatched end", query: "SELECT 1 END", wantErr: "statement contains disallowed keyword END"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.CheckReadOnlyStatement(tt.query)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckReadOnlyStatement() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CheckReadOnlyStatement() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueryReadOnly(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	// A single connection makes sure the read-only query and the later write share it.
+	conn.DB.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	var count int
+	err := conn.Query(ctx, true, "SELECT count(*) FROM tables", nil, func(rows *sql.Rows) error {
+		for rows.Next() {
+			if err := rows.Scan(&count); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatalf("Read-only query failed: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 rows, got %d", count)
+	}
+
+	err = conn.Query(ctx, true, "DELETE FROM tables", nil, func(rows *sql.Rows) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "statement rejected") {
+		t.Errorf("Expected the DELETE to be rejected, got %v", err)
+	}
+
+	// query_only must have been reset before the connection went back to the pool.
+	if _, err := conn.DB.ExecContext(ctx, "INSERT INTO tables (name, rows, size) VALUES ('audit', 1, 1)"); err != nil {
+		t.Errorf("Expected writes to work again after the read-only query, got %v", err)
+	}
+}
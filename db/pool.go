@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"job_runner/config"
+	dberrors "job_runner/errors"
+)
+
+// Pool keeps one *sql.DB per normalized DSN so that requests reuse open
+// connections instead of paying a full connect/authenticate round trip each time.
+// Pools that have not been used for longer than the idle timeout are closed, and so is
+// the least recently used pool when opening another one would exceed the maximum.
+type Pool struct {
+	mu          sync.Mutex
+	entries     map[string]*poolEntry
+	idleTimeout time.Duration
+	maxPools    int
+	closed      bool
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// poolEntry is a cached connection together with the options it was opened with.
+type poolEntry struct {
+	conn     *Connection
+	opts     config.ConnectionOptions
+	lastUsed time.Time
+}
+
+// NewPool creates a connection pool registry.
+// If idleTimeout is positive, a background goroutine closes pools that have been idle for longer than that.
+// If maxPools is positive, at most that many pools are kept open.
+func NewPool(idleTimeout time.Duration, maxPools int) *Pool {
+	p := &Pool{
+		entries:     make(map[string]*poolEntry),
+		idleTimeout: idleTimeout,
+		maxPools:    maxPools,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.evictLoop()
+	} else {
+		close(p.done)
+	}
+	return p
+}
+
+// Get returns the shared connection for the DSN, opening it if needed.
+// If the cached connection was opened with different options (e.g. after a config reload),
+// it is replaced by a new one. Callers must not Close the returned connection.
+func (p *Pool) Get(ctx context.Context, dsn string, connOpts config.ConnectionOptions) (*Connection, error) {
+	driverName, normalizedDSN, err := normalizeDSN(dsn, connOpts)
+	if err != nil {
+		return nil, err
+	}
+	key := driverName + "|" + normalizedDSN
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, dberrors.NewDBError("connection pool is closed")
+	}
+	if entry, ok := p.entries[key]; ok {
+		if reflect.DeepEqual(entry.opts, connOpts) {
+			entry.lastUsed = time.Now()
+			p.mu.Unlock()
+			return entry.conn, nil
+		}
+		// Connection options changed since the pool was opened, rebuild it.
+		delete(p.entries, key)
+		go closeConnection(entry.conn, "connection options changed")
+	}
+	p.mu.Unlock()
+
+	// Open without holding the lock so a slow connect does not block other DSNs.
+	conn, err := openNormalized(ctx, driverName, normalizedDSN, connOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		go closeConnection(conn, "connection pool closed")
+		return nil, dberrors.NewDBError("connection pool is closed")
+	}
+	if entry, ok := p.entries[key]; ok && reflect.DeepEqual(entry.opts, connOpts) {
+		// Another request opened the same pool in the meantime; use that one.
+		go closeConnection(conn, "duplicate pool")
+		entry.lastUsed = time.Now()
+		return entry.conn, nil
+	}
+	if p.maxPools > 0 && len(p.entries) >= p.maxPools {
+		p.evictLeastRecentlyUsed()
+	}
+	p.entries[key] = &poolEntry{conn: conn, opts: connOpts, lastUsed: time.Now()}
+	return conn, nil
+}
+
+// evictLeastRecentlyUsed closes the pool that has not been used for the longest time, to make
+// room for another one. Queries already running on it are allowed to finish. p.mu must be held.
+func (p *Pool) evictLeastRecentlyUsed() {
+	var lruKey string
+	var lru *poolEntry
+	for key, entry := range p.entries {
+		if lru == nil || entry.lastUsed.Before(lru.lastUsed) {
+			lruKey, lru = key, entry
+		}
+	}
+	if lru != nil {
+		delete(p.entries, lruKey)
+		go closeConnection(lru.conn, "maximum number of pools reached")
+	}
+}
+
+// Len returns the number of open pools.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// Close closes all pools and stops the idle eviction. The Pool cannot be used afterwards.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	entries := p.entries
+	p.entries = make(map[string]*poolEntry)
+	p.mu.Unlock()
+
+	close(p.stop)
+	<-p.done
+
+	var errs []error
+	for _, entry := range entries {
+		if err := entry.conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// evictLoop periodically closes pools that have been idle for longer than the idle timeout.
+func (p *Pool) evictLoop() {
+	defer close(p.done)
+
+	interval := p.idleTimeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.evictIdle(now)
+		}
+	}
+}
+
+// evictIdle closes the pools that have not been used since before now minus the idle timeout.
+func (p *Pool) evictIdle(now time.Time) {
+	p.mu.Lock()
+	var idle []*poolEntry
+	for key, entry := range p.entries {
+		if now.Sub(entry.lastUsed) > p.idleTimeout {
+			idle = append(idle, entry)
+			delete(p.entries, key)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, entry := range idle {
+		closeConnection(entry.conn, "idle timeout")
+	}
+}
+
+// closeConnection closes a pooled connection, logging any failure.
+func closeConnection(conn *Connection, reason string) {
+	if err := conn.Close(); err != nil {
+		slog.Warn("Failed to close pooled database connection", "reason", reason, "error", err)
+	}
+}
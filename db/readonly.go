@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	dberrors "job_runner/errors"
+)
+
+// writeKeywords are keywords that indicate a statement may change data or schema,
+// even when it starts with SELECT or WITH (e.g. SELECT ... INTO, data-modifying CTEs).
+var writeKeywords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "UPSERT": true,
+	"DROP": true, "CREATE": true, "ALTER": true, "TRUNCATE": true, "RENAME": true,
+	"GRANT": true, "REVOKE": true, "INTO": true, "EXEC": true, "EXECUTE": true,
+	"CALL": true, "ATTACH": true, "DETACH": true, "PRAGMA": true, "VACUUM": true,
+	"COMMIT": true, "ROLLBACK": true, "BEGIN": true, "START": true, "END": true,
+	"SET": true, "SAVEPOINT": true, "RELEASE": true, "DO": true, "COPY": true, "LOCK": true,
+}
+
+// CheckReadOnlyStatement returns an error unless the query is a single SELECT or WITH
+// statement without any keyword that could modify data. String literals, quoted
+// identifiers and comments are ignored.
+func CheckReadOnlyStatement(query string) error {
+	var code strings.Builder
+	forEachCodeSpan(query, func(start, end int) {
+		code.WriteString(query[start:end])
+		code.WriteByte(' ')
+	})
+
+	statement := strings.TrimSpace(code.String())
+	statement = strings.TrimSuffix(statement, ";")
+	if strings.Contains(statement, ";") {
+		return fmt.Errorf("multiple statements are not allowed")
+	}
+
+	words := strings.FieldsFunc(statement, func(r rune) bool {
+		return !(r == '_' || r < 128 && (isLetter(byte(r)) || isDigit(byte(r))))
+	})
+	if len(words) == 0 {
+		return fmt.Errorf("empty statement")
+	}
+	if first := strings.ToUpper(words[0]); first != "SELECT" && first != "WITH" {
+		return fmt.Errorf("only SELECT and WITH statements are allowed, got %s", first)
+	}
+	openCases := 0
+	for i, word := range words[1:] {
+		upper := strings.ToUpper(word)
+		switch {
+		case upper == "CASE":
+			openCases++
+			continue
+		case upper == "END" && openCases > 0:
+			// END closes a CASE expression.
+			openCases--
+			continue
+		case upper == "START" && i+2 < len(words) && strings.EqualFold(words[i+2], "WITH"):
+			// START WITH of an Oracle hierarchical query.
+			continue
+		}
+		if writeKeywords[upper] {
+			return fmt.Errorf("statement contains disallowed keyword %s", upper)
+		}
+	}
+	return nil
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Query runs the query and passes the resulting rows to fn, closing them afterwards.
+// With readOnly set, the statement must pass CheckReadOnlyStatement and is executed
+// inside a transaction that is always rolled back. Where the database supports it the
+// transaction is also made read-only: SET TRANSACTION READ ONLY on PostgreSQL and
+// Oracle, PRAGMA query_only on SQLite. SQL Server has no read-only transactions, so
+// there the rollback is what discards any change; it cannot undo effects outside the
+// transaction, which is why such sources should use a login that can only read.
+func (c *Connection) Query(ctx context.Context, readOnly bool, query string, args []any, fn func(*sql.Rows) error) error {
+	if !readOnly {
+		rows, err := c.ExecuteQuery(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return fn(rows)
+	}
+
+	if c.DB == nil {
+		return dberrors.NewDBError("database connection is nil")
+	}
+	if err := CheckReadOnlyStatement(query); err != nil {
+		return dberrors.Wrap(dberrors.CodeStatementRejected, err, "statement rejected")
+	}
+
+	query, args, err := BindArgs(c.Driver, query, args)
+	if err != nil {
+		return dberrors.WrapQueryError(err, "bind arguments failed")
+	}
+
+	sqlConn, err := c.DB.Conn(ctx)
+	if err != nil {
+		return dberrors.WrapDBError(err, "failed to get connection")
+	}
+	defer sqlConn.Close()
+
+	if c.Driver == "sqlite" {
+		if _, err := sqlConn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+			return dberrors.WrapDBError(err, "failed to enable query_only")
+		}
+		defer func() {
+			// query_only is a connection setting; it must be reset before the connection
+			// goes back to the pool. If that fails, the connection is discarded instead.
+			if _, err := sqlConn.ExecContext(context.Background(), "PRAGMA query_only = OFF"); err != nil {
+				slog.Warn("Failed to reset query_only, discarding connection", "error", err)
+				sqlConn.Raw(func(any) error { return driver.ErrBadConn })
+			}
+		}()
+	}
+
+	tx, err := sqlConn.BeginTx(ctx, nil)
+	if err != nil {
+		return dberrors.WrapDBError(err, "failed to begin transaction")
+	}
+	defer tx.Rollback() // Never committed: nothing the statement did is kept.
+
+	switch c.Driver {
+	case "postgres", "pgx", "oracle":
+		if _, err := tx.ExecContext(ctx, "SET TRANSACTION READ ONLY"); err != nil {
+			return dberrors.WrapDBError(err, "failed to make transaction read-only")
+		}
+	}
+
+	// Always prepared: the extended query protocol makes the server reject a query
+	// that holds more than one statement, should one get past CheckReadOnlyStatement.
+	rows, err := c.queryWith(ctx, tx, query, args, true)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return fn(rows)
+}
@@ -0,0 +1,127 @@
+package db
+
+import "strings"
+
+// forEachCodeSpan calls fn with the start and end offsets of every part of the query
+// that is SQL code, i.e. not inside a string literal, a quoted identifier or a comment.
+// It understands '...' and "..." (with doubled quotes as escapes), `...`,
+// -- and /* */ comments, and PostgreSQL escape strings (E'...', with backslash
+// escapes) and dollar-quoted strings.
+func forEachCodeSpan(query string, fn func(start, end int)) {
+	start := 0
+	i := 0
+	for i < len(query) {
+		skipTo := -1
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			skipTo = skipQuoted(query, i, c, c == '\'' && isEscapeStringPrefix(query, i))
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				skipTo = i + end + 1
+			} else {
+				skipTo = len(query)
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				skipTo = i + 2 + end + 2
+			} else {
+				skipTo = len(query)
+			}
+		case c == '$' && (i == 0 || !isIdentifierByte(query[i-1])):
+			// A $ inside an identifier (Oracle's v$session, PostgreSQL's x$a) is not a quote.
+			if tag, ok := dollarQuoteTag(query[i:]); ok {
+				if end := strings.Index(query[i+len(tag):], tag); end >= 0 {
+					skipTo = i + len(tag) + end + len(tag)
+				} else {
+					skipTo = len(query)
+				}
+			}
+		}
+
+		if skipTo < 0 {
+			i++
+			continue
+		}
+		if i > start {
+			fn(start, i)
+		}
+		i = skipTo
+		start = skipTo
+	}
+	if start < len(query) {
+		fn(start, len(query))
+	}
+}
+
+// skipQuoted returns the offset just past the quoted section that starts at i.
+// A doubled quote character inside the section is treated as an escaped quote,
+// and with backslashEscapes set so is any character following a backslash.
+func skipQuoted(query string, i int, quote byte, backslashEscapes bool) int {
+	for j := i + 1; j < len(query); j++ {
+		if backslashEscapes && query[j] == '\\' {
+			j++
+			continue
+		}
+		if query[j] != quote {
+			continue
+		}
+		if j+1 < len(query) && query[j+1] == quote {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(query)
+}
+
+// isEscapeStringPrefix reports whether the quote at i opens a PostgreSQL escape string,
+// i.e. it follows an E that is not the end of a longer identifier.
+func isEscapeStringPrefix(query string, i int) bool {
+	if i == 0 || (query[i-1] != 'E' && query[i-1] != 'e') {
+		return false
+	}
+	return i == 1 || !isIdentifierByte(query[i-2])
+}
+
+// dollarQuoteTag returns the opening tag ("$$" or "$tag$") if s starts with a PostgreSQL dollar quote.
+// Positional placeholders such as $1 are not dollar quotes.
+func dollarQuoteTag(s string) (string, bool) {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '$':
+			return s[:j+1], true
+		case c == '_' || isLetter(c) || (j > 1 && isDigit(c)):
+			continue
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// identifierEnd returns the offset just past the identifier starting at i, or i if there is none.
+func identifierEnd(s string, i int) int {
+	if i >= len(s) || !(s[i] == '_' || isLetter(s[i])) {
+		return i
+	}
+	j := i + 1
+	for j < len(s) && (s[j] == '_' || isLetter(s[j]) || isDigit(s[j])) {
+		j++
+	}
+	return j
+}
+
+// isIdentifierByte reports whether c can be part of an unquoted identifier.
+// Bytes of non-ASCII characters count, as PostgreSQL allows them in identifiers.
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || isLetter(c) || isDigit(c)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
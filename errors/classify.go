@@ -0,0 +1,153 @@
+package errors
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"net"
+	"strings"
+)
+
+// Error classes reported in the error_type label of status metrics. Unlike error messages,
+// they form a small fixed set, so they neither grow the number of series nor leak hostnames
+// or connection details.
+const (
+	ClassConnect    = "connect"     // The server could not be reached or the connection was lost
+	ClassAuth       = "auth"        // The credentials were rejected
+	ClassTimeout    = "timeout"     // The operation did not complete in time
+	ClassSyntax     = "syntax"      // The query is invalid or refers to unknown objects
+	ClassPermission = "permission"  // The operation is not allowed
+	ClassConversion = "conversion"  // A value has an unexpected type or format
+	ClassDNS        = "dns"         // A host name could not be resolved
+	ClassTLS        = "tls"         // The TLS handshake or certificate verification failed
+	ClassHTTPStatus = "http_status" // A target answered with an unexpected HTTP status code
+	ClassOther      = "other"       // Any other error
+)
+
+// sqlStateError is implemented by the errors of drivers that report SQLSTATE codes, such as
+// the PostgreSQL drivers.
+type sqlStateError interface {
+	SQLState() string
+}
+
+// Classify returns the class of err, or an empty string for a nil error. Errors are classified
+// by their type where the cause is available, then by their message.
+func Classify(err error) string {
+	if err == nil {
+		return ""
+	}
+	if class := classifyType(err); class != "" {
+		return class
+	}
+	if class := classifyMessage(strings.ToLower(err.Error())); class != "" {
+		return class
+	}
+	return ClassOther
+}
+
+// classifyType classifies err by the types in its chain.
+func classifyType(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var stateErr sqlStateError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var opErr *net.OpError
+	switch code := CodeOf(err); {
+	case stderrors.Is(err, context.DeadlineExceeded), code == CodeTimeout:
+		return ClassTimeout
+	case code == CodeStatementRejected, code == CodeForbidden:
+		return ClassPermission
+	case stderrors.As(err, &dnsErr):
+		return ClassDNS
+	case stderrors.As(err, &certErr), stderrors.As(err, &recordErr), stderrors.As(err, &authorityErr),
+		stderrors.As(err, &hostnameErr), stderrors.As(err, &invalidErr):
+		return ClassTLS
+	case stderrors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	case stderrors.As(err, &stateErr):
+		return classifySQLState(stateErr.SQLState())
+	case stderrors.As(err, &opErr):
+		return ClassConnect
+	}
+	return ""
+}
+
+// classifySQLState classifies a SQLSTATE code by its class, the first two characters.
+func classifySQLState(state string) string {
+	switch {
+	case state == "42501":
+		return ClassPermission
+	case state == "57014":
+		return ClassTimeout // Canceled by statement_timeout
+	case strings.HasPrefix(state, "08"), strings.HasPrefix(state, "53"), strings.HasPrefix(state, "57"):
+		return ClassConnect
+	case strings.HasPrefix(state, "28"):
+		return ClassAuth
+	case strings.HasPrefix(state, "42"):
+		return ClassSyntax
+	case strings.HasPrefix(state, "22"):
+		return ClassConversion
+	}
+	return ClassOther
+}
+
+// messagePatterns maps lowercase message fragments to error classes, for errors whose cause is
+// only available as text. More specific fragments come first.
+var messagePatterns = []struct {
+	fragment string
+	class    string
+}{
+	{"deadline exceeded", ClassTimeout},
+	{"timed out", ClassTimeout},
+	{"timeout", ClassTimeout},
+	{"no such host", ClassDNS},
+	{"server misbehaving", ClassDNS},
+	{"x509:", ClassTLS},
+	{"tls:", ClassTLS},
+	{"certificate", ClassTLS},
+	{"password authentication failed", ClassAuth},
+	{"authentication failed", ClassAuth},
+	{"login failed", ClassAuth},
+	{"access denied", ClassAuth},
+	{"invalid username/password", ClassAuth},
+	{"permission denied", ClassPermission},
+	{"not authorized", ClassPermission},
+	{"statement rejected", ClassPermission},
+	{"readonly database", ClassPermission},
+	{"read-only transaction", ClassPermission},
+	{"syntax error", ClassSyntax},
+	{"no such column", ClassSyntax},
+	{"no such table", ClassSyntax},
+	{"does not exist", ClassSyntax},
+	{"invalid object name", ClassSyntax},
+	{"invalid column name", ClassSyntax},
+	{"invalid identifier", ClassSyntax},
+	{"table or view does not exist", ClassSyntax},
+	{"cannot convert", ClassConversion},
+	{"converting", ClassConversion},
+	{"invalid input syntax", ClassConversion},
+	{"out of range", ClassConversion},
+	{"connection refused", ClassConnect},
+	{"connection reset", ClassConnect},
+	{"broken pipe", ClassConnect},
+	{"failed to connect", ClassConnect},
+	{"ping failed", ClassConnect},
+	{"failed to open database", ClassConnect},
+	{"unable to open database", ClassConnect},
+	{"bad connection", ClassConnect},
+}
+
+// classifyMessage classifies a lowercase error message by the fragments it contains.
+func classifyMessage(message string) string {
+	for _, p := range messagePatterns {
+		if strings.Contains(message, p.fragment) {
+			return p.class
+		}
+	}
+	return ""
+}
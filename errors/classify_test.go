@@ -0,0 +1,53 @@
+package errors_test
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	dberrors "job_runner/errors"
+)
+
+// stateError is a driver error with a SQLSTATE code.
+type stateError struct{ state string }
+
+func (e *stateError) Error() string    { return "driver error" }
+func (e *stateError) SQLState() string { return e.state }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "deadline", err: fmt.Errorf("query failed: %w", context.DeadlineExceeded), want: dberrors.ClassTimeout},
+		{name: "dns", err: &net.DNSError{Err: "no such host", Name: "db.internal"}, want: dberrors.ClassDNS},
+		{name: "refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, want: dberrors.ClassConnect},
+		{name: "certificate", err: fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}), want: dberrors.ClassTLS},
+		{name: "auth state", err: &stateError{state: "28P01"}, want: dberrors.ClassAuth},
+		{name: "permission state", err: &stateError{state: "42501"}, want: dberrors.ClassPermission},
+		{name: "syntax state", err: fmt.Errorf("execute: %w", &stateError{state: "42601"}), want: dberrors.ClassSyntax},
+		{name: "conversion state", err: &stateError{state: "22P02"}, want: dberrors.ClassConversion},
+		{name: "canceled state", err: &stateError{state: "57014"}, want: dberrors.ClassTimeout},
+		{name: "connection state", err: &stateError{state: "08006"}, want: dberrors.ClassConnect},
+		{name: "unknown state", err: &stateError{state: "XX000"}, want: dberrors.ClassOther},
+		{name: "timeout message", err: dberrors.NewDBError("ping failed: i/o timeout"), want: dberrors.ClassTimeout},
+		{name: "auth message", err: dberrors.NewDBError(`ping failed: pq: password authentication failed for user "app"`), want: dberrors.ClassAuth},
+		{name: "syntax message", err: dberrors.NewQueryError("execute query failed: SQL logic error: no such column: x (1)"), want: dberrors.ClassSyntax},
+		{name: "rejected statement", err: dberrors.NewQueryError("statement rejected: multiple statements are not allowed"), want: dberrors.ClassPermission},
+		{name: "conversion message", err: fmt.Errorf("sql: Scan error: converting driver.Value type string to a float64"), want: dberrors.ClassConversion},
+		{name: "connect message", err: dberrors.NewDBError("ping failed: dial tcp 10.0.0.1:5432: connect: connection refused"), want: dberrors.ClassConnect},
+		{name: "other", err: dberrors.NewQueryError("duplicate series x: several rows have the same labels"), want: dberrors.ClassOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dberrors.Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
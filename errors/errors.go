@@ -1,14 +1,148 @@
 package errors
 
-import "fmt"
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+)
 
-// BaseError represents a basic error with a message
+// Code identifies the kind of an error. Every code maps to one HTTP status code, see HTTPStatus.
+type Code string
+
+const (
+	CodeInvalidRequest    Code = "invalid_request"    // The request parameters are invalid
+	CodeMethodNotAllowed  Code = "method_not_allowed" // The HTTP method is not supported
+	CodeForbidden         Code = "forbidden"          // The configuration does not allow the request
+	CodeStatementRejected Code = "statement_rejected" // The read-only guard rejected the statement
+	CodeUnavailable       Code = "unavailable"        // A database or check target could not be reached
+	CodeTimeout           Code = "timeout"            // The task did not complete in time
+	CodeCanceled          Code = "canceled"           // The request was canceled before the task completed
+	CodeQueryFailed       Code = "query_failed"       // The query failed or its result could not be converted
+	CodeLimitExceeded     Code = "limit_exceeded"     // The output exceeded a limit under the fail policy
+	CodeConfig            Code = "config"             // The configuration is invalid
+	CodeInternal          Code = "internal"           // Any other error
+)
+
+// httpStatuses maps error codes to HTTP status codes. Codes not listed map to 500.
+var httpStatuses = map[Code]int{
+	CodeInvalidRequest:    http.StatusBadRequest,
+	CodeMethodNotAllowed:  http.StatusMethodNotAllowed,
+	CodeForbidden:         http.StatusForbidden,
+	CodeStatementRejected: http.StatusBadRequest,
+	CodeUnavailable:       http.StatusServiceUnavailable,
+	CodeTimeout:           http.StatusGatewayTimeout,
+	CodeCanceled:          http.StatusServiceUnavailable,
+}
+
+// titles are short, human-readable summaries of the error codes.
+var titles = map[Code]string{
+	CodeInvalidRequest:    "Invalid request",
+	CodeMethodNotAllowed:  "Method not allowed",
+	CodeForbidden:         "Request not allowed",
+	CodeStatementRejected: "Statement rejected",
+	CodeUnavailable:       "Service unavailable",
+	CodeTimeout:           "Task timed out",
+	CodeCanceled:          "Request canceled",
+	CodeQueryFailed:       "Query failed",
+	CodeLimitExceeded:     "Output limit exceeded",
+	CodeConfig:            "Invalid configuration",
+	CodeInternal:          "Internal error",
+}
+
+// retryableCodes are the codes of errors that may not occur again if the request is retried.
+var retryableCodes = map[Code]bool{
+	CodeUnavailable: true,
+	CodeTimeout:     true,
+	CodeCanceled:    true,
+}
+
+// HTTPStatus returns the HTTP status code of errors with code c.
+func (c Code) HTTPStatus() int {
+	if status, ok := httpStatuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Title returns a short, human-readable summary of errors with code c.
+func (c Code) Title() string {
+	if title, ok := titles[c]; ok {
+		return title
+	}
+	return titles[CodeInternal]
+}
+
+// coder is implemented by errors that carry a code.
+type coder interface {
+	ErrorCode() Code
+}
+
+// retryer is implemented by errors that know whether retrying may succeed.
+type retryer interface {
+	IsRetryable() bool
+}
+
+// BaseError represents an error with a code, a message and an optional cause
 type BaseError struct {
-	Message string
+	Code      Code
+	Message   string
+	Cause     error
+	Retryable bool // Retrying the request may succeed
 }
 
 func (e BaseError) Error() string {
-	return e.Message
+	switch {
+	case e.Cause == nil:
+		return e.Message
+	case e.Message == "":
+		return e.Cause.Error()
+	}
+	return e.Message + ": " + e.Cause.Error()
+}
+
+// Unwrap returns the cause of the error, for errors.Is and errors.As.
+func (e BaseError) Unwrap() error {
+	return e.Cause
+}
+
+// ErrorCode returns the code of the error.
+func (e BaseError) ErrorCode() Code {
+	return e.Code
+}
+
+// IsRetryable reports whether retrying the request may succeed.
+func (e BaseError) IsRetryable() bool {
+	return e.Retryable
+}
+
+// newBase creates a BaseError. A cause that is a context error decides the code, since a
+// deadline or cancellation is what made the operation fail whatever it was.
+func newBase(code Code, message string, cause error) BaseError {
+	switch {
+	case stderrors.Is(cause, context.DeadlineExceeded):
+		code = CodeTimeout
+	case stderrors.Is(cause, context.Canceled):
+		code = CodeCanceled
+	}
+	return BaseError{Code: code, Message: message, Cause: cause, Retryable: retryableCodes[code]}
+}
+
+// Error is an error with a code, for errors that belong to no more specific type
+type Error struct {
+	BaseError
+}
+
+// New creates an error with the given code
+func New(code Code, message string) *Error {
+	return &Error{BaseError: newBase(code, message, nil)}
+}
+
+// Wrap creates an error with the given code caused by cause. An empty message keeps the
+// message of the cause. A deadline or cancellation in the cause makes it a timeout or
+// canceled error instead.
+func Wrap(code Code, cause error, message string) *Error {
+	return &Error{BaseError: newBase(code, message, cause)}
 }
 
 // DBError represents a database-related error
@@ -18,10 +152,13 @@ type DBError struct {
 
 // NewDBError creates a new database error
 func NewDBError(message string) *DBError {
+	return WrapDBError(nil, message)
+}
+
+// WrapDBError creates a new database error caused by cause
+func WrapDBError(cause error, message string) *DBError {
 	return &DBError{
-		BaseError: BaseError{
-			Message: fmt.Sprintf("Database error: %s", message),
-		},
+		BaseError: newBase(CodeUnavailable, fmt.Sprintf("Database error: %s", message), cause),
 	}
 }
 
@@ -32,10 +169,13 @@ type QueryError struct {
 
 // NewQueryError creates a new query error
 func NewQueryError(message string) *QueryError {
+	return WrapQueryError(nil, message)
+}
+
+// WrapQueryError creates a new query error caused by cause
+func WrapQueryError(cause error, message string) *QueryError {
 	return &QueryError{
-		BaseError: BaseError{
-			Message: fmt.Sprintf("Query error: %s", message),
-		},
+		BaseError: newBase(CodeQueryFailed, fmt.Sprintf("Query error: %s", message), cause),
 	}
 }
 
@@ -47,9 +187,7 @@ type ConfigError struct {
 // NewConfigError creates a new configuration error
 func NewConfigError(message string) *ConfigError {
 	return &ConfigError{
-		BaseError: BaseError{
-			Message: fmt.Sprintf("Configuration error: %s", message),
-		},
+		BaseError: newBase(CodeConfig, fmt.Sprintf("Configuration error: %s", message), nil),
 	}
 }
 
@@ -61,8 +199,38 @@ type ServerError struct {
 // NewServerError creates a new server error
 func NewServerError(message string) *ServerError {
 	return &ServerError{
-		BaseError: BaseError{
-			Message: fmt.Sprintf("Server error: %s", message),
-		},
+		BaseError: newBase(CodeInternal, fmt.Sprintf("Server error: %s", message), nil),
+	}
+}
+
+// CodeOf returns the code of the outermost error in the chain of err that has one. Errors
+// without a code are timeout or canceled errors if they are caused by a context error, and
+// internal errors otherwise. CodeOf returns an empty code for a nil error.
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var c coder
+	if stderrors.As(err, &c) {
+		return c.ErrorCode()
+	}
+	return newBase(CodeInternal, "", err).Code
+}
+
+// HTTPStatus returns the HTTP status code of err, given by its code (see CodeOf), or 200 for
+// a nil error.
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return CodeOf(err).HTTPStatus()
+}
+
+// IsRetryable reports whether retrying the request that failed with err may succeed.
+func IsRetryable(err error) bool {
+	var r retryer
+	if stderrors.As(err, &r) {
+		return r.IsRetryable()
 	}
+	return retryableCodes[CodeOf(err)]
 }
@@ -0,0 +1,70 @@
+package errors_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	dberrors "job_runner/errors"
+)
+
+func TestWrap(t *testing.T) {
+	err := dberrors.Wrap(dberrors.CodeQueryFailed, io.ErrUnexpectedEOF, "failed to execute query")
+	if err.Error() != "failed to execute query: unexpected EOF" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("errors.Is did not find the cause")
+	}
+	if got := dberrors.Wrap(dberrors.CodeInvalidRequest, io.EOF, "").Error(); got != "EOF" {
+		t.Errorf("Error() without message = %q, want the message of the cause", got)
+	}
+
+	// Wrapped by the standard library, the error keeps its code and type
+	wrapped := fmt.Errorf("task failed: %w", dberrors.WrapDBError(io.EOF, "ping failed"))
+	var dbErr *dberrors.DBError
+	if !errors.As(wrapped, &dbErr) || dbErr.Error() != "Database error: ping failed: EOF" {
+		t.Errorf("errors.As did not find the DBError in %v", wrapped)
+	}
+	if !errors.Is(wrapped, io.EOF) {
+		t.Errorf("errors.Is did not find the cause of the DBError")
+	}
+}
+
+func TestCodeOf(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		code      dberrors.Code
+		status    int
+		retryable bool
+	}{
+		{name: "nil", err: nil, code: "", status: http.StatusOK},
+		{name: "invalid request", err: dberrors.New(dberrors.CodeInvalidRequest, "missing parameter"), code: dberrors.CodeInvalidRequest, status: http.StatusBadRequest},
+		{name: "forbidden", err: dberrors.New(dberrors.CodeForbidden, "disabled"), code: dberrors.CodeForbidden, status: http.StatusForbidden},
+		{name: "database", err: dberrors.NewDBError("connection pool is closed"), code: dberrors.CodeUnavailable, status: http.StatusServiceUnavailable, retryable: true},
+		{name: "query", err: dberrors.NewQueryError("no such column"), code: dberrors.CodeQueryFailed, status: http.StatusInternalServerError},
+		{name: "config", err: dberrors.NewConfigError("bad"), code: dberrors.CodeConfig, status: http.StatusInternalServerError},
+		{name: "outermost code", err: dberrors.Wrap(dberrors.CodeInvalidRequest, dberrors.NewQueryError("bad"), ""), code: dberrors.CodeInvalidRequest, status: http.StatusBadRequest},
+		{name: "deadline cause", err: dberrors.WrapQueryError(fmt.Errorf("read: %w", context.DeadlineExceeded), "execute query failed"), code: dberrors.CodeTimeout, status: http.StatusGatewayTimeout, retryable: true},
+		{name: "canceled cause", err: dberrors.Wrap(dberrors.CodeUnavailable, context.Canceled, "request failed"), code: dberrors.CodeCanceled, status: http.StatusServiceUnavailable, retryable: true},
+		{name: "uncoded", err: io.EOF, code: dberrors.CodeInternal, status: http.StatusInternalServerError},
+		{name: "uncoded deadline", err: context.DeadlineExceeded, code: dberrors.CodeTimeout, status: http.StatusGatewayTimeout, retryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dberrors.CodeOf(tt.err); got != tt.code {
+				t.Errorf("CodeOf() = %q, want %q", got, tt.code)
+			}
+			if got := dberrors.HTTPStatus(tt.err); got != tt.status {
+				t.Errorf("HTTPStatus() = %d, want %d", got, tt.status)
+			}
+			if got := dberrors.IsRetryable(tt.err); got != tt.retryable {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.retryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package metric
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NullPolicy decides what happens to NULL values in value columns.
+type NullPolicy string
+
+// Supported NULL policies.
+const (
+	NullSkip NullPolicy = "skip" // Write no sample
+	NullZero NullPolicy = "zero" // Write 0
+	NullNaN  NullPolicy = "nan"  // Write NaN
+)
+
+// ParseNullPolicy parses a NULL policy name. An empty string means skip.
+func ParseNullPolicy(s string) (NullPolicy, error) {
+	switch p := NullPolicy(strings.ToLower(s)); p {
+	case "":
+		return NullSkip, nil
+	case NullSkip, NullZero, NullNaN:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported null value policy %q (supported: nan, skip, zero)", s)
+	}
+}
+
+// nullValue returns the value written for NULL, or false if the sample is skipped.
+func (p NullPolicy) nullValue() (float64, bool) {
+	switch p {
+	case NullZero:
+		return 0, true
+	case NullNaN:
+		return math.NaN(), true
+	default:
+		return 0, false
+	}
+}
+
+// columnKind classifies a result column by its database type. Drivers often return
+// values of such columns as text, which is then converted according to the kind.
+type columnKind int
+
+const (
+	kindOther    columnKind = iota
+	kindNumeric             // Integer and floating-point types
+	kindBool                // BOOL, BOOLEAN, BIT
+	kindTime                // DATE, DATETIME, TIMESTAMP and variants
+	kindInterval            // INTERVAL and variants
+	kindDecimal             // NUMERIC, DECIMAL, NUMBER
+)
+
+// columnKinds returns the kind of every result column. Columns whose database type the
+// driver does not report, such as expressions in SQLite, are classified by their scan type.
+func columnKinds(rows *sql.Rows, n int) ([]columnKind, error) {
+	kinds := make([]columnKind, n)
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	for i, ct := range types {
+		if i >= n {
+			break
+		}
+		if name := ct.DatabaseTypeName(); name != "" {
+			kinds[i] = kindOfDatabaseType(name)
+		} else if scanType := ct.ScanType(); scanType != nil {
+			kinds[i] = kindOfScanType(scanType)
+		}
+	}
+	return kinds, nil
+}
+
+// numericTypes are the database type names of integer and floating-point columns.
+var numericTypes = map[string]bool{
+	"INT": true, "INTEGER": true, "TINYINT": true, "SMALLINT": true, "MEDIUMINT": true, "BIGINT": true,
+	"INT2": true, "INT4": true, "INT8": true,
+	"FLOAT": true, "FLOAT4": true, "FLOAT8": true, "REAL": true, "DOUBLE": true, "DOUBLE PRECISION": true,
+	"BINARY_FLOAT": true, "BINARY_DOUBLE": true,
+}
+
+// kindOfDatabaseType maps a database type name, as reported by the driver, to a column kind.
+func kindOfDatabaseType(name string) columnKind {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		name = strings.TrimSpace(name[:i]) // DECIMAL(10,2), BIT(1)
+	}
+	name = strings.TrimPrefix(name, "UNSIGNED ") // MySQL
+	switch {
+	case numericTypes[name]:
+		return kindNumeric
+	case name == "BOOL" || name == "BOOLEAN" || name == "BIT":
+		return kindBool
+	case name == "NUMERIC" || name == "DECIMAL" || name == "NUMBER":
+		return kindDecimal
+	case strings.HasPrefix(name, "INTERVAL"):
+		return kindInterval
+	case strings.HasPrefix(name, "TIMESTAMP") || strings.HasPrefix(name, "DATETIME") ||
+		name == "DATE" || name == "SMALLDATETIME":
+		return kindTime
+	default:
+		return kindOther
+	}
+}
+
+// exactFloater is implemented by *big.Rat and driver-specific decimal types.
+type exactFloater interface {
+	Float64() (float64, bool)
+}
+
+// bigFloater is implemented by *big.Float and *big.Int.
+type bigFloater interface {
+	Float64() (float64, big.Accuracy)
+}
+
+// kindOfScanType maps the Go type a driver scans a column into to a column kind.
+func kindOfScanType(t reflect.Type) columnKind {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			return kindInterval
+		}
+		return kindNumeric
+	case reflect.Bool:
+		return kindBool
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return kindTime
+	case reflect.TypeOf(sql.NullInt64{}), reflect.TypeOf(sql.NullInt32{}), reflect.TypeOf(sql.NullInt16{}),
+		reflect.TypeOf(sql.NullByte{}), reflect.TypeOf(sql.NullFloat64{}):
+		return kindNumeric
+	case reflect.TypeOf(sql.NullBool{}):
+		return kindBool
+	case reflect.TypeOf(sql.NullTime{}):
+		return kindTime
+	}
+	return kindOther
+}
+
+// convertValue converts a non-NULL column value of the given kind to a sample value.
+// Booleans become 0 or 1, time values unix seconds and durations seconds, whatever the
+// column type; text is interpreted according to the kind. Other values are converted
+// by convertToFloat64.
+func convertValue(value interface{}, kind columnKind) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case time.Time:
+		return unixSeconds(v), !v.IsZero()
+	case time.Duration:
+		return v.Seconds(), true
+	case exactFloater:
+		f, _ := v.Float64()
+		return f, true
+	case bigFloater:
+		f, _ := v.Float64()
+		return f, true
+	case []byte:
+		if kind == kindBool && len(v) == 1 && v[0] <= 1 {
+			return float64(v[0]), true // BIT(1) as returned by MySQL
+		}
+		return convertText(string(v), value, kind)
+	case string:
+		return convertText(v, value, kind)
+	}
+	if kind == kindTime {
+		if t, ok := convertToTimestamp(value); ok {
+			return unixSeconds(t), true
+		}
+		return 0, false
+	}
+	return convertToFloat64(value)
+}
+
+// convertText converts a value returned as text according to the kind of its column.
+// Decimals are parsed with strconv.ParseFloat, which rounds correctly, so the result is
+// the float64 nearest to the exact decimal value.
+func convertText(s string, value interface{}, kind columnKind) (float64, bool) {
+	switch kind {
+	case kindBool:
+		if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+			if b {
+				return 1, true
+			}
+			return 0, true
+		}
+	case kindTime:
+		if t, ok := convertToTimestamp(strings.TrimSpace(s)); ok {
+			return unixSeconds(t), true
+		}
+		return 0, false
+	case kindInterval:
+		if seconds, ok := parseInterval(s); ok {
+			return seconds, true
+		}
+		return 0, false
+	case kindDecimal:
+		value = strings.TrimSpace(s)
+	}
+	return convertToFloat64(value)
+}
+
+// unixSeconds returns t as unix seconds with fractional nanoseconds.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9
+}
+
+// Lengths of the interval units in seconds. As in PostgreSQL's EXTRACT(EPOCH FROM interval),
+// a month is 30 days and a year 365.25 days.
+var intervalUnits = map[string]float64{
+	"microsecond": 1e-6,
+	"millisecond": 1e-3,
+	"second":      1,
+	"sec":         1,
+	"minute":      60,
+	"min":         60,
+	"hour":        3600,
+	"day":         86400,
+	"week":        7 * 86400,
+	"mon":         30 * 86400,
+	"month":       30 * 86400,
+	"year":        365.25 * 86400,
+}
+
+// parseInterval parses a duration in seconds from a PostgreSQL interval in the default
+// output style, such as "1 year 2 mons 3 days 04:05:06.5" or "-00:00:30", or from a Go
+// duration string such as "1h30m".
+func parseInterval(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Seconds(), true
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	var total float64
+	for i := 0; i < len(fields); i++ {
+		if strings.Contains(fields[i], ":") {
+			seconds, ok := parseClock(fields[i])
+			if !ok {
+				return 0, false
+			}
+			total += seconds
+			continue
+		}
+		if i+1 == len(fields) {
+			return 0, false
+		}
+		n, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return 0, false
+		}
+		i++
+		unit, ok := intervalUnits[strings.TrimSuffix(strings.ToLower(fields[i]), "s")]
+		if !ok {
+			return 0, false
+		}
+		total += n * unit
+	}
+	return total, true
+}
+
+// parseClock parses the time part of an interval, [-+]HH:MM[:SS[.fraction]], in seconds.
+func parseClock(s string) (float64, bool) {
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var total float64
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		total += n * math.Pow(60, float64(2-i))
+	}
+	return sign * total, true
+}
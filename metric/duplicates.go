@@ -0,0 +1,62 @@
+package metric
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	dberrors "job_runner/errors"
+)
+
+// DuplicatePolicy decides what happens when several rows produce the same series.
+type DuplicatePolicy string
+
+// Supported duplicate policies.
+const (
+	DuplicateError DuplicatePolicy = "error" // Fail the query
+	DuplicateLast  DuplicatePolicy = "last"  // Keep the value of the last row
+	DuplicateFirst DuplicatePolicy = "first" // Keep the value of the first row
+	DuplicateSum   DuplicatePolicy = "sum"
+	DuplicateMax   DuplicatePolicy = "max"
+	DuplicateMin   DuplicatePolicy = "min"
+)
+
+// ParseDuplicatePolicy parses a duplicate policy name. An empty string means error.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(strings.ToLower(s)); p {
+	case "":
+		return DuplicateError, nil
+	case DuplicateError, DuplicateLast, DuplicateFirst, DuplicateSum, DuplicateMax, DuplicateMin:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported duplicate policy %q (supported: error, first, last, max, min, sum)", s)
+	}
+}
+
+// mergeDuplicate counts a duplicate of the named series, which already has the value old,
+// and returns the value to keep according to the duplicate policy.
+func (g *Generator) mergeDuplicate(series string, old, value float64) (float64, error) {
+	g.Duplicates++
+	switch g.OnDuplicate {
+	case DuplicateLast:
+		return value, nil
+	case DuplicateFirst:
+		return old, nil
+	case DuplicateSum:
+		return old + value, nil
+	case DuplicateMax:
+		return math.Max(old, value), nil
+	case DuplicateMin:
+		return math.Min(old, value), nil
+	default:
+		return 0, dberrors.NewQueryError(fmt.Sprintf("duplicate series %s: several rows have the same labels (use on_duplicate to aggregate them)", series))
+	}
+}
+
+// seriesName formats a series for messages as name{labels}.
+func seriesName(name string, labels []Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + "{" + formatLabels(labels) + "}"
+}
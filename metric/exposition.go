@@ -0,0 +1,353 @@
+package metric
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricType is the Prometheus type of a metric family.
+type MetricType string
+
+// Supported metric types.
+const (
+	TypeGauge     MetricType = "gauge"
+	TypeCounter   MetricType = "counter"
+	TypeUntyped   MetricType = "untyped"
+	TypeHistogram MetricType = "histogram"
+	TypeSummary   MetricType = "summary"
+)
+
+// ParseMetricType parses a metric type name. An empty string means gauge.
+func ParseMetricType(s string) (MetricType, error) {
+	switch t := MetricType(strings.ToLower(s)); t {
+	case "":
+		return TypeGauge, nil
+	case TypeGauge, TypeCounter, TypeUntyped, TypeHistogram, TypeSummary:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported metric type %q (supported: counter, gauge, histogram, summary, untyped)", s)
+	}
+}
+
+// Label is a single label name/value pair of a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Set collects metric families and writes them in the Prometheus text exposition format,
+// including # HELP and # TYPE metadata. A Set is not safe for concurrent use.
+type Set struct {
+	naming
+	limiter
+	families map[string]*family
+	count    int // Number of series
+}
+
+// naming holds the name scheme and constant labels that a Set or Encoder applies to samples.
+type naming struct {
+	constLabels []Label
+	scheme      NameScheme
+}
+
+// limiter holds the output limits of a Set or Encoder.
+type limiter struct {
+	maxSeries int
+	maxBytes  int
+	truncated string // Name of the first limit that was exceeded
+}
+
+// Names of the limits a Set, Encoder or Generator can truncate output at.
+const (
+	LimitMaxSeries        = "max_series"
+	LimitMaxRows          = "max_rows"
+	LimitMaxResponseBytes = "max_response_bytes"
+)
+
+// family is a metric family: its metadata and samples in insertion order.
+type family struct {
+	help     string
+	typ      MetricType
+	series   []*series
+	byLabels map[string]*series
+}
+
+// series is one sample of a family.
+type series struct {
+	suffix    string // Appended to the family name, e.g. _bucket for histograms
+	labels    string // Formatted label pairs without the surrounding braces
+	value     float64
+	timestamp time.Time // Written in milliseconds unless zero
+}
+
+// NewSet creates an empty Set.
+func NewSet() *Set {
+	return &Set{families: make(map[string]*family)}
+}
+
+// SetNameScheme sets how metric and label names added afterwards are sanitized. The default is LegacyNames.
+func (n *naming) SetNameScheme(scheme NameScheme) {
+	n.scheme = scheme
+}
+
+// SetConstLabels sets labels that are added to every sample added afterwards.
+// A label of the sample itself takes precedence over a constant label with the same name.
+func (n *naming) SetConstLabels(labels []Label) {
+	n.constLabels = labels
+}
+
+// nameScheme returns the name scheme samples are added with.
+func (n *naming) nameScheme() NameScheme {
+	return n.scheme
+}
+
+// SetLimits limits the output to maxSeries series and maxBytes bytes. Zero means no limit.
+// Samples beyond a limit are dropped; Truncated reports which limit was exceeded.
+func (l *limiter) SetLimits(maxSeries, maxBytes int) {
+	l.maxSeries, l.maxBytes = maxSeries, maxBytes
+}
+
+// Truncated returns the name of the first limit that caused samples to be dropped,
+// such as LimitMaxSeries, or an empty string if the output is complete.
+func (l *limiter) Truncated() string {
+	return l.truncated
+}
+
+// truncate records that samples were dropped because of the named limit.
+func (l *limiter) truncate(limit string) {
+	if l.truncated == "" {
+		l.truncated = limit
+	}
+}
+
+// stopped reports whether samples are dropped because a limit was exceeded.
+func (l *limiter) stopped() bool {
+	return l.truncated != ""
+}
+
+// Describe sets the type and HELP text of a metric family. An empty help keeps the current text.
+func (s *Set) Describe(name string, typ MetricType, help string) {
+	f := s.family(s.scheme.metricName(name))
+	f.typ = typ
+	if help != "" {
+		f.help = help
+	}
+}
+
+// Add sets the value of the sample identified by name and labels.
+// Families that have not been described are exposed as gauges.
+// If a sample with the same name and labels exists, its value is replaced.
+func (s *Set) Add(name string, labels []Label, value float64) {
+	s.AddSample(name, "", labels, value, time.Time{})
+}
+
+// AddAt is like Add with an explicit sample timestamp.
+func (s *Set) AddAt(name string, labels []Label, value float64, ts time.Time) {
+	s.AddSample(name, "", labels, value, ts)
+}
+
+// AddSample is like AddAt for a sample named name+suffix that belongs to the family name,
+// such as the _bucket, _sum and _count samples of histograms and summaries.
+// A zero ts writes the sample without a timestamp. A new series beyond the series limit is dropped.
+func (s *Set) AddSample(name, suffix string, labels []Label, value float64, ts time.Time) {
+	f := s.family(s.scheme.metricName(name))
+	formatted := s.seriesLabels(labels)
+	key := suffix + "{" + formatted
+	if sr, ok := f.byLabels[key]; ok {
+		sr.value, sr.timestamp = value, ts
+		return
+	}
+	if s.maxSeries > 0 && s.count >= s.maxSeries {
+		s.truncate(LimitMaxSeries)
+		return
+	}
+	sr := &series{suffix: suffix, labels: formatted, value: value, timestamp: ts}
+	f.series = append(f.series, sr)
+	f.byLabels[key] = sr
+	s.count++
+}
+
+// Get returns the value of the sample identified by name and labels, if the set has one.
+func (s *Set) Get(name string, labels []Label) (float64, bool) {
+	f, ok := s.families[s.scheme.metricName(name)]
+	if !ok {
+		return 0, false
+	}
+	sr, ok := f.byLabels["{"+s.seriesLabels(labels)]
+	if !ok {
+		return 0, false
+	}
+	return sr.value, true
+}
+
+// Len returns the number of samples in the set.
+func (s *Set) Len() int {
+	return s.count
+}
+
+// WritePrometheus writes all families, sorted by name, in the Prometheus text exposition format.
+// With a byte limit, writing stops before the first sample that does not fit.
+func (s *Set) WritePrometheus(w io.Writer) {
+	names := make([]string, 0, len(s.families))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	written := 0
+	var line strings.Builder
+	for _, name := range names {
+		f := s.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		header := formatHeader(name, f.help, f.typ)
+		for i, sr := range f.series {
+			line.Reset()
+			if i == 0 {
+				line.WriteString(header) // Only written together with the first sample
+			}
+			writeSample(&line, name+sr.suffix, sr.labels, sr.value, sr.timestamp)
+			if s.maxBytes > 0 && written+line.Len() > s.maxBytes {
+				s.truncate(LimitMaxResponseBytes)
+				return
+			}
+			bw.WriteString(line.String())
+			written += line.Len()
+		}
+	}
+}
+
+// family returns the named family, creating it as a gauge if needed.
+func (s *Set) family(name string) *family {
+	f, ok := s.families[name]
+	if !ok {
+		f = &family{typ: TypeGauge, byLabels: make(map[string]*series)}
+		s.families[name] = f
+	}
+	return f
+}
+
+// seriesLabels returns the formatted labels of a sample: its own labels with their names
+// sanitized, followed by the constant labels.
+func (n *naming) seriesLabels(labels []Label) string {
+	return formatLabels(n.withConstLabels(n.labelNames(labels)))
+}
+
+// labelNames returns labels with their names sanitized according to the name scheme.
+func (n *naming) labelNames(labels []Label) []Label {
+	result := make([]Label, len(labels))
+	for i, l := range labels {
+		result[i] = Label{Name: n.scheme.labelName(l.Name), Value: l.Value}
+	}
+	return result
+}
+
+// withConstLabels appends the constant labels that the sample does not define itself.
+func (n *naming) withConstLabels(labels []Label) []Label {
+	if len(n.constLabels) == 0 {
+		return labels
+	}
+	result := make([]Label, len(labels), len(labels)+len(n.constLabels))
+	copy(result, labels)
+	for _, cl := range n.constLabels {
+		if !hasLabel(labels, cl.Name) {
+			result = append(result, cl)
+		}
+	}
+	return result
+}
+
+// hasLabel reports whether labels contain a label with the given name.
+func hasLabel(labels []Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formatLabels formats label pairs as name="value",... in the given order, escaping the values.
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = quoteName(l.Name, false) + `="` + escapeLabelValue(l.Value) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatHeader returns the # HELP and # TYPE lines of a family. The HELP line is left out without help text.
+func formatHeader(name, help string, typ MetricType) string {
+	var header string
+	if help != "" {
+		header = fmt.Sprintf("# HELP %s %s\n", quoteName(name, true), escapeHelp(help))
+	}
+	return header + fmt.Sprintf("# TYPE %s %s\n", quoteName(name, true), typ)
+}
+
+// writeSample writes a sample line. A zero ts writes it without a timestamp.
+func writeSample(line *strings.Builder, name, labels string, value float64, ts time.Time) {
+	writeSeriesName(line, name, labels)
+	line.WriteByte(' ')
+	line.WriteString(formatValue(value))
+	if !ts.IsZero() {
+		line.WriteByte(' ')
+		line.WriteString(strconv.FormatInt(ts.UnixMilli(), 10))
+	}
+	line.WriteByte('\n')
+}
+
+// writeSeriesName writes the name and labels of a sample. A name that is not a valid
+// legacy metric name is quoted inside the braces, as in {"my.metric",label="value"}.
+func writeSeriesName(bw *strings.Builder, name, labels string) {
+	if !isLegacyName(name, true) {
+		bw.WriteString(`{"`)
+		bw.WriteString(escapeLabelValue(name))
+		bw.WriteByte('"')
+		if labels != "" {
+			bw.WriteByte(',')
+			bw.WriteString(labels)
+		}
+		bw.WriteByte('}')
+		return
+	}
+	bw.WriteString(name)
+	if labels != "" {
+		bw.WriteByte('{')
+		bw.WriteString(labels)
+		bw.WriteByte('}')
+	}
+}
+
+// escapeHelp escapes backslashes and line feeds in HELP text.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// formatValue formats a sample value. Integral values are written without exponent.
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return strconv.FormatInt(int64(v), 10)
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
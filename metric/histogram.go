@@ -0,0 +1,223 @@
+package metric
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dberrors "job_runner/errors"
+)
+
+// ParseFloatList parses a comma-separated list of numbers, such as histogram buckets or summary quantiles.
+func ParseFloatList(s string) ([]float64, error) {
+	var values []float64
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", item)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// validateDistribution checks the histogram and summary settings of the generator.
+func (g *Generator) validateDistribution() error {
+	switch g.Type {
+	case TypeHistogram:
+		if g.BucketColumn == "" && len(g.Buckets) == 0 {
+			return fmt.Errorf("histogram requires a bucket column or buckets")
+		}
+		if g.BucketColumn != "" && len(g.Buckets) > 0 {
+			return fmt.Errorf("bucket column and buckets cannot be combined")
+		}
+		for i, b := range g.Buckets {
+			if math.IsNaN(b) || i > 0 && b <= g.Buckets[i-1] {
+				return fmt.Errorf("buckets must be in increasing order")
+			}
+		}
+		if len(g.Quantiles) > 0 {
+			return fmt.Errorf("quantiles are only supported for summaries")
+		}
+	case TypeSummary:
+		if g.BucketColumn != "" || len(g.Buckets) > 0 {
+			return fmt.Errorf("buckets are only supported for histograms")
+		}
+		for _, q := range g.Quantiles {
+			if !(q >= 0 && q <= 1) {
+				return fmt.Errorf("quantile %v is not between 0 and 1", q)
+			}
+		}
+	default:
+		if g.BucketColumn != "" || len(g.Buckets) > 0 || len(g.Quantiles) > 0 {
+			return fmt.Errorf("buckets and quantiles require metric type histogram or summary")
+		}
+	}
+	if g.SumColumn != "" && g.BucketColumn == "" {
+		return fmt.Errorf("sum column requires a bucket column")
+	}
+	return nil
+}
+
+// distribution accumulates the rows of one histogram or summary series.
+type distribution struct {
+	name   string
+	labels []Label
+	bounds map[float64]float64 // Pre-aggregated buckets: upper bound to cumulative count
+	counts []float64           // Raw observations per configured bucket (not cumulative)
+	values []float64           // Raw observations of a summary
+	sum    float64
+	hasSum bool
+	count  float64
+	// timestamp is the latest timestamp of the rows, shared by all samples of the series
+	timestamp time.Time
+}
+
+// distributions collects distributions by metric name and label set in insertion order.
+type distributions struct {
+	order []*distribution
+	byKey map[string]*distribution
+}
+
+func newDistributions() *distributions {
+	return &distributions{byKey: make(map[string]*distribution)}
+}
+
+// get returns the distribution for the given metric name and labels, creating it if needed.
+func (ds *distributions) get(name string, labels []Label) *distribution {
+	key := name + "{" + formatLabels(labels)
+	d, ok := ds.byKey[key]
+	if !ok {
+		d = &distribution{name: name, labels: labels, bounds: make(map[float64]float64)}
+		ds.order = append(ds.order, d)
+		ds.byKey[key] = d
+	}
+	return d
+}
+
+// setTimestamp keeps the latest timestamp seen for the distribution.
+func (d *distribution) setTimestamp(ts time.Time) {
+	if ts.After(d.timestamp) {
+		d.timestamp = ts
+	}
+}
+
+// observe records a raw value: it is counted into the configured buckets or kept for the quantiles.
+func (g *Generator) observe(d *distribution, value float64) {
+	if g.Type == TypeHistogram {
+		if d.counts == nil {
+			d.counts = make([]float64, len(g.Buckets))
+		}
+		if i := sort.SearchFloat64s(g.Buckets, value); i < len(g.Buckets) {
+			d.counts[i]++
+		}
+	} else {
+		d.values = append(d.values, value)
+	}
+	d.sum += value
+	d.hasSum = true
+	d.count++
+}
+
+// writeDistributions adds the _bucket, _sum and _count samples (and the quantiles of summaries)
+// of every collected distribution to out.
+func (g *Generator) writeDistributions(out sink, ds *distributions) error {
+	for _, d := range ds.order {
+		var err error
+		switch {
+		case g.Type == TypeSummary:
+			writeSummary(out, d, g.Quantiles)
+		case g.BucketColumn != "":
+			err = writeBucketedHistogram(out, d)
+		default:
+			writeHistogram(out, d, g.Buckets)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHistogram writes a histogram aggregated from raw values into the given buckets.
+func writeHistogram(out sink, d *distribution, buckets []float64) {
+	var cumulative float64
+	for i, bound := range buckets {
+		if d.counts != nil {
+			cumulative += d.counts[i]
+		}
+		out.AddSample(d.name, "_bucket", withLabel(d.labels, "le", formatValue(bound)), cumulative, d.timestamp)
+	}
+	out.AddSample(d.name, "_bucket", withLabel(d.labels, "le", "+Inf"), d.count, d.timestamp)
+	out.AddSample(d.name, "_sum", d.labels, d.sum, d.timestamp)
+	out.AddSample(d.name, "_count", d.labels, d.count, d.timestamp)
+}
+
+// writeBucketedHistogram writes a histogram from pre-aggregated cumulative bucket counts.
+// A missing +Inf bucket is added with the largest count. Without a sum column, _sum is omitted.
+func writeBucketedHistogram(out sink, d *distribution) error {
+	bounds := make([]float64, 0, len(d.bounds)+1)
+	for bound := range d.bounds {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+
+	var previous float64
+	for _, bound := range bounds {
+		count := d.bounds[bound]
+		if count < previous {
+			return dberrors.NewQueryError(fmt.Sprintf("histogram %s: bucket counts are not cumulative (le=%s has %s, less than %s)",
+				d.name, formatValue(bound), formatValue(count), formatValue(previous)))
+		}
+		previous = count
+	}
+	if len(bounds) == 0 || !math.IsInf(bounds[len(bounds)-1], 1) {
+		bounds = append(bounds, math.Inf(1))
+		d.bounds[math.Inf(1)] = previous
+	}
+
+	for _, bound := range bounds {
+		out.AddSample(d.name, "_bucket", withLabel(d.labels, "le", formatValue(bound)), d.bounds[bound], d.timestamp)
+	}
+	if d.hasSum {
+		out.AddSample(d.name, "_sum", d.labels, d.sum, d.timestamp)
+	}
+	out.AddSample(d.name, "_count", d.labels, d.bounds[math.Inf(1)], d.timestamp)
+	return nil
+}
+
+// writeSummary writes a summary with the given quantiles computed from the raw values.
+func writeSummary(out sink, d *distribution, quantiles []float64) {
+	sort.Float64s(d.values)
+	for _, q := range quantiles {
+		out.AddAt(d.name, withLabel(d.labels, "quantile", formatValue(q)), quantile(d.values, q), d.timestamp)
+	}
+	out.AddSample(d.name, "_sum", d.labels, d.sum, d.timestamp)
+	out.AddSample(d.name, "_count", d.labels, d.count, d.timestamp)
+}
+
+// quantile returns the q-quantile of the sorted values using the nearest-rank method.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// withLabel returns a copy of labels with the given label appended.
+func withLabel(labels []Label, name, value string) []Label {
+	result := make([]Label, len(labels), len(labels)+1)
+	copy(result, labels)
+	return append(result, Label{Name: name, Value: value})
+}
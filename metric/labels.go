@@ -0,0 +1,131 @@
+package metric
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dberrors "job_runner/errors"
+)
+
+// ParseColumnList parses comma-separated column names. Each entry may itself be a list.
+func ParseColumnList(specs ...string) []string {
+	var columns []string
+	for _, spec := range specs {
+		for _, item := range strings.Split(spec, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				columns = append(columns, item)
+			}
+		}
+	}
+	return columns
+}
+
+// ParseLabelRenames parses label renames of the form "column:label". Each entry may itself
+// be a comma-separated list. The result maps column names to label names.
+func ParseLabelRenames(specs ...string) (map[string]string, error) {
+	renames := make(map[string]string)
+	for _, item := range ParseColumnList(specs...) {
+		column, label, ok := strings.Cut(item, ":")
+		column, label = strings.TrimSpace(column), strings.TrimSpace(label)
+		if !ok || column == "" || label == "" {
+			return nil, fmt.Errorf("invalid rename %q: expected column:label", item)
+		}
+		if err := ValidateLabelName(label); err != nil {
+			return nil, fmt.Errorf("invalid rename %q: %w", item, err)
+		}
+		renames[column] = label
+	}
+	return renames, nil
+}
+
+// LabelsFromMap converts a name/value map to labels sorted by name, checking that every name
+// is a valid label name.
+func LabelsFromMap(m map[string]string) ([]Label, error) {
+	labels := make([]Label, 0, len(m))
+	for name, value := range m {
+		if err := ValidateLabelName(name); err != nil {
+			return nil, err
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels, nil
+}
+
+// ValidateLabelName reports an error if name is not a valid label name or is reserved (starts with __).
+func ValidateLabelName(name string) error {
+	if name == "" || isASCIIDigit(name[0]) {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c != '_' && !isASCIILetter(c) && !isASCIIDigit(c) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name %q is reserved", name)
+	}
+	return nil
+}
+
+// labelColumn is a result column exposed as a label.
+type labelColumn struct {
+	index int
+	name  string // Label name
+}
+
+// resolveLabelColumns determines which columns become labels and under which names.
+// Column names are sanitized according to the name scheme unless they are renamed.
+// Columns in excluded (value and special columns) never become labels.
+func (g *Generator) resolveLabelColumns(columns []string, excluded map[int]bool, scheme NameScheme) ([]labelColumn, error) {
+	selected := make(map[int]bool, len(columns))
+	if len(g.LabelColumns) > 0 {
+		for _, name := range g.LabelColumns {
+			index := findColumn(columns, name)
+			if index == -1 {
+				return nil, dberrors.NewQueryError(fmt.Sprintf("label column '%s' not found in result set", name))
+			}
+			if excluded[index] {
+				return nil, dberrors.NewQueryError(fmt.Sprintf("column '%s' cannot be both a label column and a value or special column", name))
+			}
+			selected[index] = true
+		}
+	} else {
+		for i := range columns {
+			selected[i] = !excluded[i]
+		}
+	}
+	for _, name := range g.DropColumns {
+		if index := findColumn(columns, name); index >= 0 {
+			selected[index] = false
+		}
+	}
+
+	var labelCols []labelColumn
+	seen := make(map[string]string, len(columns)+len(g.ConstLabels))
+	for _, l := range g.ConstLabels {
+		seen[l.Name] = "a constant label"
+	}
+	for i, col := range columns {
+		if !selected[i] {
+			continue
+		}
+		name := scheme.labelName(col)
+		for from, to := range g.RenameLabels {
+			if strings.EqualFold(from, col) {
+				name = to
+				if err := ValidateLabelName(name); err != nil {
+					return nil, dberrors.WrapQueryError(err, fmt.Sprintf("column '%s'", col))
+				}
+				break
+			}
+		}
+		if other, ok := seen[name]; ok {
+			return nil, dberrors.NewQueryError(fmt.Sprintf("label '%s' of column '%s' is also defined by %s", name, col, other))
+		}
+		seen[name] = fmt.Sprintf("column '%s'", col)
+		labelCols = append(labelCols, labelColumn{index: i, name: name})
+	}
+	return labelCols, nil
+}
@@ -1,16 +1,19 @@
 package metric
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog" // Changed from log
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	dberrors "job_runner/errors"
 
-	"github.com/VictoriaMetrics/metrics"
 	"github.com/google/uuid" // Added for UUID parsing
 )
 
@@ -18,6 +21,95 @@ import (
 type Generator struct {
 	MetricPrefix string
 	ValueColumn  string
+	// Mode decides how rows become samples. In ModeInfo every row becomes a sample named
+	// after the prefix with the value 1 and all columns as labels; in ModeRowCount the
+	// number of rows is the only sample. The value columns are not used in either mode.
+	// In ModeWide the value columns are found by column type, see resolveWideColumns.
+	Mode Mode
+	// ValueColumns, if set, replaces ValueColumn: every listed column becomes its own
+	// metric and the remaining columns become labels.
+	ValueColumns []ValueColumn
+	// NameColumn, if set, takes the metric name from this column's value (long-format results).
+	// The name is sanitized and prefixed with MetricPrefix unless the prefix is empty;
+	// rows whose value does not give a valid metric name are skipped.
+	NameColumn string
+	// Type is the metric type announced in the # TYPE line of every generated family.
+	Type MetricType
+	// Help, if set, is written as the # HELP text of every generated family.
+	Help string
+	// Label shaping. By default every column that is not a value or special column becomes
+	// a label named after the column, in result column order, followed by ConstLabels.
+
+	// LabelColumns, if set, lists the only columns that become labels.
+	LabelColumns []string
+	// DropColumns lists columns that do not become labels.
+	DropColumns []string
+	// RenameLabels maps column names to the label names they are exposed as.
+	RenameLabels map[string]string
+	// ConstLabels are added to every generated series, sorted by name (see LabelsFromMap).
+	ConstLabels []Label
+	// NullLabelValue is the label value used for NULL columns.
+	NullLabelValue string
+
+	// OnDuplicate decides what happens when several rows produce the same series.
+	OnDuplicate DuplicatePolicy
+	// Duplicates is the number of duplicate series found by the last GenerateFromRows call.
+	Duplicates int
+
+	// MaxRows, if set, is the number of rows read at most. Reading stops at the first row beyond
+	// it, or once the set or encoder has dropped a sample because of its own limits, and the
+	// output is marked as truncated (see Set.Truncated).
+	MaxRows int
+
+	// NullValue decides what NULL values in value columns become.
+	NullValue NullPolicy
+	// SkippedRows is the number of rows of the last GenerateFromRows call that were skipped,
+	// entirely or for some value columns, because a value could not be converted to a number.
+	SkippedRows int
+
+	// TimestampColumn, if set, gives every sample of a row an explicit timestamp taken from this column.
+	// It accepts time values, unix seconds and unix milliseconds; see convertToTimestamp.
+	TimestampColumn string
+
+	// Histograms and summaries are built from the value column(s). A histogram either counts
+	// raw values into Buckets or, with BucketColumn, reads pre-aggregated buckets whose value
+	// column holds the cumulative count. A summary computes Quantiles from raw values.
+
+	// Buckets are the upper bounds raw values are counted into, in increasing order (+Inf is implied).
+	Buckets []float64
+	// BucketColumn holds the upper bound (le) of a pre-aggregated bucket.
+	BucketColumn string
+	// SumColumn optionally holds the sum of observations of pre-aggregated buckets.
+	SumColumn string
+	// Quantiles are the quantiles (0 to 1) a summary exposes.
+	Quantiles []float64
+}
+
+// ValueColumn is a result column exposed as a metric of its own.
+type ValueColumn struct {
+	Column     string
+	MetricName string // Defaults to <prefix>_<column>; used as the name suffix with NameColumn
+}
+
+// ParseValueColumns parses value column specifications of the form "column" or
+// "column:metric_name". Each entry may itself be a comma-separated list.
+func ParseValueColumns(specs ...string) ([]ValueColumn, error) {
+	var columns []ValueColumn
+	for _, spec := range specs {
+		for _, item := range strings.Split(spec, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			column, metricName, _ := strings.Cut(item, ":")
+			column, metricName = strings.TrimSpace(column), strings.TrimSpace(metricName)
+			if column == "" {
+				return nil, fmt.Errorf("invalid value column %q: empty column name", item)
+			}
+			columns = append(columns, ValueColumn{Column: column, MetricName: metricName})
+		}
+	}
+	return columns, nil
 }
 
 // NewGenerator creates a new metric generator
@@ -33,6 +125,10 @@ func NewGenerator(metricPrefix, valueColumn string) *Generator {
 	return &Generator{
 		MetricPrefix: metricPrefix,
 		ValueColumn:  valueColumn,
+		Mode:         ModeValue,
+		Type:         TypeGauge,
+		OnDuplicate:  DuplicateError,
+		NullValue:    NullSkip,
 	}
 }
 
@@ -91,24 +187,167 @@ func convertToFloat64(value interface{}) (float64, bool) {
 	}
 }
 
+// Validate checks that the generator settings can be combined.
+func (g *Generator) Validate() error {
+	if err := g.validateMode(); err != nil {
+		return err
+	}
+	return g.validateDistribution()
+}
+
+// metricType returns the type of the generated families; an unset type means gauge.
+func (g *Generator) metricType() MetricType {
+	if g.Type == "" {
+		return TypeGauge
+	}
+	return g.Type
+}
+
+// timestampLayouts are the layouts accepted for textual timestamps, tried in order.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// unixMillisThreshold separates unix seconds from unix milliseconds: larger numbers are
+// taken as milliseconds (1e11 seconds is in the year 5138, 1e11 milliseconds in 1973).
+const unixMillisThreshold = 1e11
+
+// convertToTimestamp attempts to convert a column value to a sample timestamp.
+// It handles time.Time, unix seconds and unix milliseconds as numbers or strings,
+// and timestamps stored as text (RFC 3339 or "2006-01-02 15:04:05", UTC if no zone is given).
+func convertToTimestamp(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case []byte:
+		return convertToTimestamp(string(v))
+	case string:
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	}
+
+	f, ok := convertToFloat64(value)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	if math.Abs(f) < unixMillisThreshold {
+		f *= 1000
+	}
+	return time.UnixMilli(int64(math.Round(f))), true
+}
+
 // GenerateFromRows creates metrics from SQL query results
 // It adds the generated metrics to the provided set.
-func (g *Generator) GenerateFromRows(set *metrics.Set, rows *sql.Rows) error {
+func (g *Generator) GenerateFromRows(set *Set, rows *sql.Rows) error {
+	return g.generate(set, rows)
+}
+
+// StreamFromRows is like GenerateFromRows, but writes every sample to enc as soon as its row
+// is read, so the result set is never held in memory. It fails if the settings of the
+// generator do not allow streaming; see CheckStreamable.
+func (g *Generator) StreamFromRows(enc *Encoder, rows *sql.Rows) error {
+	if err := g.CheckStreamable(); err != nil {
+		return dberrors.NewQueryError(err.Error())
+	}
+	return g.generate(enc, rows)
+}
+
+// generate creates metrics from the rows and adds them to out.
+func (g *Generator) generate(out sink, rows *sql.Rows) error {
+	if err := g.Validate(); err != nil {
+		return dberrors.NewQueryError(err.Error())
+	}
+	g.Duplicates = 0
+	g.SkippedRows = 0
+	if g.Mode == ModeRowCount {
+		return g.generateRowCount(out, rows)
+	}
+
 	columns, err := rows.Columns()
 	if err != nil {
-		return dberrors.NewQueryError(fmt.Sprintf("failed to get columns: %v", err))
+		return dberrors.WrapQueryError(err, "failed to get columns")
+	}
+	kinds, err := columnKinds(rows, len(columns))
+	if err != nil {
+		return dberrors.WrapQueryError(err, "failed to get column types")
 	}
 
-	// Find the value column index
-	valueColIndex := -1
-	for i, col := range columns {
-		if strings.EqualFold(col, g.ValueColumn) {
-			valueColIndex = i
-			break
+	valueCols, err := g.resolveValueColumns(columns, kinds)
+	if err != nil {
+		return err
+	}
+	// Columns that are not labels: value columns and the special columns below
+	isValueCol := make(map[int]bool, len(valueCols))
+	for _, vc := range valueCols {
+		isValueCol[vc.index] = true
+	}
+	isSpecialCol := make(map[int]bool)
+	findSpecialColumn := func(kind, name string) (int, error) {
+		if name == "" {
+			return -1, nil
 		}
+		index := findColumn(columns, name)
+		if index == -1 {
+			return -1, dberrors.NewQueryError(fmt.Sprintf("%s column '%s' not found in result set", kind, name))
+		}
+		if isValueCol[index] {
+			return -1, dberrors.NewQueryError(fmt.Sprintf("column '%s' cannot be both the %s column and a value column", name, kind))
+		}
+		if isSpecialCol[index] {
+			return -1, dberrors.NewQueryError(fmt.Sprintf("column '%s' cannot be used as the %s column and another special column", name, kind))
+		}
+		isSpecialCol[index] = true
+		return index, nil
+	}
+
+	nameColIndex, err := findSpecialColumn("name", g.NameColumn)
+	if err != nil {
+		return err
 	}
-	if valueColIndex == -1 {
-		return dberrors.NewQueryError(fmt.Sprintf("value column '%s' not found in result set", g.ValueColumn))
+	bucketColIndex, err := findSpecialColumn("bucket", g.BucketColumn)
+	if err != nil {
+		return err
+	}
+	sumColIndex, err := findSpecialColumn("sum", g.SumColumn)
+	if err != nil {
+		return err
+	}
+	timestampColIndex, err := findSpecialColumn("timestamp", g.TimestampColumn)
+	if err != nil {
+		return err
+	}
+
+	excluded := make(map[int]bool, len(isValueCol)+len(isSpecialCol))
+	for i := range isValueCol {
+		excluded[i] = true
+	}
+	for i := range isSpecialCol {
+		excluded[i] = true
+	}
+	labelCols, err := g.resolveLabelColumns(columns, excluded, out.nameScheme())
+	if err != nil {
+		return err
+	}
+
+	metricType := g.metricType()
+	var dists *distributions
+	if metricType == TypeHistogram || metricType == TypeSummary {
+		dists = newDistributions()
+	}
+	if nameColIndex == -1 {
+		for _, vc := range valueCols {
+			out.Describe(vc.metricName, metricType, g.Help)
+		}
+		if g.Mode == ModeInfo {
+			out.Describe(g.MetricPrefix, metricType, g.Help)
+		}
 	}
 
 	// Create a destination slice to scan into
@@ -118,89 +357,332 @@ func (g *Generator) GenerateFromRows(set *metrics.Set, rows *sql.Rows) error {
 	}
 
 	// Iterate through rows
-	for rows.Next() {
+	for rowCount := 0; rows.Next(); rowCount++ {
+		if !g.readMore(out, rowCount) {
+			break
+		}
 		if err := rows.Scan(values...); err != nil {
-			return dberrors.NewQueryError(fmt.Sprintf("failed to scan row: %v", err))
-		}
-
-		// Build label string from all non-value columns
-		var labelParts []string
-		for i, col := range columns {
-			if i != valueColIndex {
-				val := *(values[i].(*interface{}))
-				if val != nil {
-					var labelValueString string
-					// Check if the value is a 16-byte slice (potential UUID)
-					if bytesVal, ok := val.([]byte); ok {
-						if len(bytesVal) == 16 { // Likely a UUID
-							u, err := uuid.FromBytes(bytesVal)
-							if err == nil {
-								labelValueString = u.String() // Convert to standard UUID string
-							} else {
-								// Log warning and fallback to default sprint if parsing failed
-								slog.Warn("Column value is a 16-byte slice but not a valid UUID", "column", col, "error", err)
-								labelValueString = fmt.Sprint(val) // Fallback to default Sprint
-							}
-						} else { // Likely a DECIMAL or other []byte type
-							labelValueString = string(bytesVal) // Convert to string directly
-						}
-					} else {
-						// Default string conversion for all other types
-						labelValueString = fmt.Sprint(val)
-					}
-					labelParts = append(labelParts, fmt.Sprintf("%s=%q", col, labelValueString))
-				}
+			return dberrors.WrapQueryError(err, "failed to scan row")
+		}
+
+		// Determine the metric name base from the name column, if used
+		var nameBase string
+		if nameColIndex >= 0 {
+			var ok bool
+			nameBase, ok = g.nameFromValue(*(values[nameColIndex].(*interface{})), out.nameScheme())
+			if !ok {
+				slog.Warn("Skipping row with invalid metric name", "column", columns[nameColIndex], "value", *(values[nameColIndex].(*interface{})))
+				continue
 			}
 		}
 
-		// Get the value from the value column
-		val := *(values[valueColIndex].(*interface{}))
-		if val == nil {
-			continue
+		// Read the bucket bound of pre-aggregated histograms
+		var bucketBound float64
+		if bucketColIndex >= 0 {
+			var ok bool
+			bucketBound, ok = convertValue(*(values[bucketColIndex].(*interface{})), kinds[bucketColIndex])
+			if !ok || math.IsNaN(bucketBound) {
+				slog.Warn("Skipping row with invalid bucket bound", "column", columns[bucketColIndex], "value", *(values[bucketColIndex].(*interface{})))
+				g.SkippedRows++
+				continue
+			}
+		}
+
+		// Read the sample timestamp; samples without a valid timestamp are written without one
+		var timestamp time.Time
+		if tsVal := columnValue(values, timestampColIndex); tsVal != nil {
+			var ok bool
+			if timestamp, ok = convertToTimestamp(tsVal); !ok {
+				slog.Warn("Ignoring invalid sample timestamp", "column", columns[timestampColIndex], "value", tsVal)
+			}
+		}
+
+		// Build labels from the label columns, followed by the constant labels
+		labels := make([]Label, 0, len(labelCols)+len(g.ConstLabels))
+		for _, lc := range labelCols {
+			value := g.NullLabelValue
+			if val := columnValue(values, lc.index); val != nil {
+				value = labelValue(columns[lc.index], val)
+			}
+			labels = append(labels, Label{Name: lc.name, Value: value})
 		}
+		labels = append(labels, g.ConstLabels...)
 
-		// Create metric name with labels
-		metricName := g.MetricPrefix
-		if len(labelParts) > 0 {
-			metricName += fmt.Sprintf("{%s}", strings.Join(labelParts, ","))
+		if g.Mode == ModeInfo {
+			metricName := g.MetricPrefix
+			if nameColIndex >= 0 {
+				metricName = nameBase
+				out.Describe(metricName, metricType, g.Help)
+			}
+			if err := g.addSample(out, metricName, labels, 1, timestamp); err != nil {
+				return err
+			}
+			continue
 		}
 
-		// Set the metric value using the helper function
-		if floatVal, ok := convertToFloat64(val); ok {
-			gauge := set.GetOrCreateGauge(metricName, nil) // Corrected: pass nil for the callback
-			gauge.Set(floatVal)
-		} else {
-			// convertToFloat64 already logs a warning, so no additional logging here unless desired
-			slog.Debug("Skipping metric due to conversion failure", "metricName", metricName, "originalValue", val)
+		skipped := false
+		for _, vc := range valueCols {
+			// Get the value from the value column; NULL is handled by the NULL policy
+			val := *(values[vc.index].(*interface{}))
+			var floatVal float64
+			var ok bool
+			if val == nil {
+				if floatVal, ok = g.NullValue.nullValue(); !ok {
+					continue
+				}
+			} else if floatVal, ok = convertValue(val, kinds[vc.index]); !ok {
+				// convertToFloat64 already logs a warning, so no additional logging here unless desired
+				slog.Debug("Skipping metric due to conversion failure", "column", columns[vc.index], "originalValue", val)
+				skipped = true
+				continue
+			}
+
+			metricName := vc.metricName
+			if nameColIndex >= 0 {
+				metricName = nameBase
+				if vc.suffix != "" {
+					metricName += "_" + vc.suffix
+				}
+				out.Describe(metricName, metricType, g.Help)
+			}
+
+			if dists == nil {
+				if err := g.addSample(out, metricName, labels, floatVal, timestamp); err != nil {
+					return err
+				}
+				continue
+			}
+			d := dists.get(metricName, labels)
+			d.setTimestamp(timestamp)
+			if bucketColIndex < 0 {
+				g.observe(d, floatVal)
+				continue
+			}
+			if old, exists := d.bounds[bucketBound]; exists {
+				series := seriesName(metricName+"_bucket", withLabel(labels, "le", formatValue(bucketBound)))
+				if floatVal, err = g.mergeDuplicate(series, old, floatVal); err != nil {
+					return err
+				}
+			}
+			d.bounds[bucketBound] = floatVal
+			if sumVal := columnValue(values, sumColIndex); sumVal != nil {
+				if sum, ok := convertValue(sumVal, kinds[sumColIndex]); ok {
+					d.sum, d.hasSum = sum, true
+				}
+			}
+		}
+		if skipped {
+			g.SkippedRows++
 		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return dberrors.NewQueryError(fmt.Sprintf("error iterating rows: %v", err))
+		return dberrors.WrapQueryError(err, "error iterating rows")
 	}
 
+	if dists != nil {
+		return g.writeDistributions(out, dists)
+	}
+	return nil
+}
+
+// addSample adds a sample to out. If out already has the series, the values
+// are merged according to the duplicate policy.
+func (g *Generator) addSample(out sink, name string, labels []Label, value float64, ts time.Time) error {
+	if old, exists := out.Get(name, labels); exists {
+		var err error
+		if value, err = g.mergeDuplicate(seriesName(name, labels), old, value); err != nil {
+			return err
+		}
+	}
+	out.AddAt(name, labels, value, ts)
 	return nil
 }
 
+// readMore reports whether another row should be read after rowCount rows, marking out
+// as truncated if the row limit is reached. Reading also stops once out takes no more samples.
+func (g *Generator) readMore(out sink, rowCount int) bool {
+	if g.MaxRows > 0 && rowCount >= g.MaxRows {
+		out.truncate(LimitMaxRows)
+	}
+	return !out.stopped()
+}
+
+// resolvedValueColumn is a value column located in the result set.
+type resolvedValueColumn struct {
+	index      int
+	metricName string
+	suffix     string // Appended to the name taken from the name column, unless empty
+}
+
+// resolveValueColumns finds the value columns in the result set and determines their metric names.
+// With a single ValueColumn the metric is named after the prefix alone; with ValueColumns
+// each metric is named <prefix>_<column> unless an explicit name is given.
+// In info mode there are no value columns.
+func (g *Generator) resolveValueColumns(columns []string, kinds []columnKind) ([]resolvedValueColumn, error) {
+	switch g.Mode {
+	case ModeInfo:
+		return nil, nil
+	case ModeWide:
+		return g.resolveWideColumns(columns, kinds)
+	}
+	if len(g.ValueColumns) == 0 {
+		index, err := findValueColumn(columns, g.ValueColumn)
+		if err != nil {
+			return nil, err
+		}
+		return []resolvedValueColumn{{index: index, metricName: g.MetricPrefix}}, nil
+	}
+
+	return g.resolveListedValueColumns(columns, g.ValueColumns)
+}
+
+// resolveListedValueColumns finds the listed value columns in the result set. Each metric is
+// named <prefix>_<column> unless an explicit name is given.
+func (g *Generator) resolveListedValueColumns(columns []string, list []ValueColumn) ([]resolvedValueColumn, error) {
+	resolved := make([]resolvedValueColumn, 0, len(list))
+	seen := make(map[int]bool, len(list))
+	for _, vc := range list {
+		index, err := findValueColumn(columns, vc.Column)
+		if err != nil {
+			return nil, err
+		}
+		if seen[index] {
+			return nil, dberrors.NewQueryError(fmt.Sprintf("value column '%s' listed more than once", vc.Column))
+		}
+		seen[index] = true
+
+		suffix := vc.MetricName
+		if suffix == "" {
+			suffix = columns[index]
+		}
+		metricName := vc.MetricName
+		if metricName == "" {
+			metricName = g.MetricPrefix + "_" + columns[index]
+		}
+		resolved = append(resolved, resolvedValueColumn{index: index, metricName: metricName, suffix: suffix})
+	}
+	return resolved, nil
+}
+
+// findValueColumn returns the index of the named value column, or an error if it is missing.
+func findValueColumn(columns []string, name string) (int, error) {
+	if i := findColumn(columns, name); i >= 0 {
+		return i, nil
+	}
+	return -1, dberrors.NewQueryError(fmt.Sprintf("value column '%s' not found in result set", name))
+}
+
+// columnValue returns the scanned value of the column at index, or nil if index is -1.
+func columnValue(values []interface{}, index int) interface{} {
+	if index < 0 {
+		return nil
+	}
+	return *(values[index].(*interface{}))
+}
+
+// findColumn returns the index of the named column (case-insensitive), or -1 if it is missing.
+func findColumn(columns []string, name string) int {
+	for i, col := range columns {
+		if strings.EqualFold(col, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nameFromValue builds a metric name from a name column value: the value is sanitized
+// and prefixed with MetricPrefix. It reports false if no valid metric name results.
+// With UTF8Names any non-empty value is used as it is.
+func (g *Generator) nameFromValue(val interface{}, scheme NameScheme) (string, bool) {
+	if val == nil {
+		return "", false
+	}
+	raw := labelValue("", val)
+	if scheme == UTF8Names {
+		if strings.TrimSpace(raw) == "" {
+			return "", false
+		}
+		if g.MetricPrefix != "" {
+			raw = g.MetricPrefix + "_" + raw
+		}
+		return raw, true
+	}
+	if !strings.ContainsFunc(raw, func(r rune) bool { return r < 128 && (isASCIILetter(byte(r)) || isASCIIDigit(byte(r))) }) {
+		return "", false
+	}
+	name := sanitizeMetricName(raw)
+	if g.MetricPrefix != "" {
+		name = g.MetricPrefix + "_" + name
+	}
+	if isASCIIDigit(name[0]) {
+		return "", false
+	}
+	return name, true
+}
+
+// labelValue converts a non-nil column value to its label value string.
+func labelValue(col string, val interface{}) string {
+	// Check if the value is a 16-byte slice (potential UUID)
+	if bytesVal, ok := val.([]byte); ok {
+		if len(bytesVal) == 16 { // Likely a UUID
+			u, err := uuid.FromBytes(bytesVal)
+			if err == nil {
+				return u.String() // Convert to standard UUID string
+			}
+			// Log warning and fallback to default sprint if parsing failed
+			slog.Warn("Column value is a 16-byte slice but not a valid UUID", "column", col, "error", err)
+			return fmt.Sprint(val) // Fallback to default Sprint
+		}
+		return string(bytesVal) // Likely a DECIMAL or other []byte type, convert to string directly
+	}
+	// Default string conversion for all other types
+	return fmt.Sprint(val)
+}
+
+// queryStatusHelp is the HELP text of the query status metric.
+const queryStatusHelp = "Whether the query succeeded (1) or failed (0)."
+
+// QueryLabel returns the label that identifies a query in status metrics: the name of a catalog
+// query, or a hash of the text of an ad-hoc query. Query texts are not used as label values,
+// as they can be long, differ for every set of literals and contain sensitive values.
+func QueryLabel(queryName, query string) Label {
+	if queryName != "" {
+		return Label{Name: "query_name", Value: queryName}
+	}
+	sum := sha256.Sum256([]byte(query))
+	return Label{Name: "query_hash", Value: hex.EncodeToString(sum[:8])}
+}
+
 // RecordQueryStatus records the status of a query execution.
-// It creates a gauge metric with the given name.
-// If an error occurs, it sets the value to 0 and adds an 'error' label with the error message.
+// It creates a gauge metric with the given name, labeled with the query label (see QueryLabel).
+// If an error occurs, it sets the value to 0 and adds an 'error_type' label with the class of
+// the error (see errors.Classify); the error message itself is left to the logs.
 // Otherwise, it sets the value to 1.
-func RecordQueryStatus(set *metrics.Set, metricName string, query string, err error) {
+func RecordQueryStatus(set *Set, metricName string, query Label, err error) {
 	var statusValue float64 = 1
-	labels := fmt.Sprintf(`{query=%q}`, query)
+	labels := []Label{query}
 
 	if err != nil {
 		statusValue = 0
-		labels = fmt.Sprintf(`{query=%q,error=%q}`, query, err.Error())
+		labels = append(labels, Label{Name: "error_type", Value: dberrors.Classify(err)})
 	}
 
-	fullMetricName := metricName + labels
-	gauge := set.GetOrCreateGauge(fullMetricName, nil)
-	gauge.Set(statusValue)
+	set.Describe(metricName, TypeGauge, queryStatusHelp)
+	set.Add(metricName, labels, statusValue)
+}
+
+// skippedRowsHelp is the HELP text of the skipped rows metric.
+const skippedRowsHelp = "Number of result rows skipped because a value could not be converted to a number."
+
+// RecordSkippedRows records how many result rows of a query were skipped because
+// a value could not be converted, as a gauge with the given name.
+func RecordSkippedRows(set *Set, metricName string, query Label, skipped int) {
+	set.Describe(metricName, TypeGauge, skippedRowsHelp)
+	set.Add(metricName, []Label{query}, float64(skipped))
 }
 
 // WriteMetrics writes the metrics in Prometheus format to the given writer.
-func WriteMetrics(w io.Writer, set *metrics.Set) {
+func WriteMetrics(w io.Writer, set *Set) {
 	set.WritePrometheus(w)
 }
@@ -3,13 +3,14 @@ package metric_test
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"job_runner/metric"
 	"job_runner/tests"
-
-	"github.com/VictoriaMetrics/metrics"
 )
 
 func TestMetricGeneration(t *testing.T) {
@@ -29,7 +30,7 @@ func TestMetricGeneration(t *testing.T) {
 	generator := metric.NewGenerator("test_metric", "value")
 
 	// Generate metrics
-	metricSet := metrics.NewSet()
+	metricSet := metric.NewSet()
 	err = generator.GenerateFromRows(metricSet, rows)
 	if err != nil {
 		t.Fatalf("Failed to generate metrics: %v", err)
@@ -76,7 +77,7 @@ func TestMetricGenerationWithDifferentValueColumn(t *testing.T) {
 	generator := metric.NewGenerator("table_size", "my_value")
 
 	// Generate metrics
-	metricSet := metrics.NewSet()
+	metricSet := metric.NewSet()
 	err = generator.GenerateFromRows(metricSet, rows)
 	if err != nil {
 		t.Fatalf("Failed to generate metrics: %v", err)
@@ -123,7 +124,7 @@ func TestMetricGenerationWithSpecialTypes(t *testing.T) {
 	generator := metric.NewGenerator("special_metric", "value")
 
 	// Generate metrics
-	metricSet := metrics.NewSet()
+	metricSet := metric.NewSet()
 	err = generator.GenerateFromRows(metricSet, rows)
 	if err != nil {
 		t.Fatalf("Failed to generate metrics: %v", err)
@@ -154,3 +155,1084 @@ func TestMetricGenerationWithSpecialTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestMetricGenerationWithMultipleValueColumns(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	rows, err := conn.ExecuteQuery(ctx, "SELECT name, rows, size FROM tables")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	valueColumns, err := metric.ParseValueColumns("rows, size:table_size_bytes")
+	if err != nil {
+		t.Fatalf("Failed to parse value columns: %v", err)
+	}
+	generator := metric.NewGenerator("table", "")
+	generator.ValueColumns = valueColumns
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	output := buf.String()
+
+	expectedMetrics := []string{
+		`table_rows{name="users"} 1250`,
+		`table_size_bytes{name="users"} 5120`,
+		`table_rows{name="categories"} 50`,
+		`table_size_bytes{name="categories"} 512`,
+	}
+	for _, expected := range expectedMetrics {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+		}
+	}
+}
+
+func TestMetricGenerationWithMissingValueColumn(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), "SELECT name, rows FROM tables")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("table", "")
+	generator.ValueColumns = []metric.ValueColumn{{Column: "rows"}, {Column: "size"}}
+
+	err = generator.GenerateFromRows(metric.NewSet(), rows)
+	if err == nil || !strings.Contains(err.Error(), "value column 'size' not found in result set") {
+		t.Errorf("Expected a missing value column error, got %v", err)
+	}
+}
+
+func TestMetricGenerationWithNameColumn(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name       string
+		prefix     string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:   "Without prefix",
+			prefix: "",
+			expected: []string{
+				"cpu_usage 45.2\n",
+				"network_out 876.23\n",
+				"free_space_pct 3\n",
+			},
+			unexpected: []string{
+				"1st_metric",
+				"sql_query_result",
+			},
+		},
+		{
+			name:   "With prefix",
+			prefix: "app",
+			expected: []string{
+				"app_cpu_usage 45.2\n",
+				"app_1st_metric 4\n",
+				"app_free_space_pct 3\n",
+			},
+		},
+	}
+
+	query := `SELECT name, value FROM metrics
+		UNION ALL SELECT 'free space-pct', 3
+		UNION ALL SELECT '1st metric', 4
+		UNION ALL SELECT NULL, 5
+		UNION ALL SELECT '%%', 6`
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := conn.ExecuteQuery(context.Background(), query)
+			if err != nil {
+				t.Fatalf("Failed to execute query: %v", err)
+			}
+			defer rows.Close()
+
+			generator := metric.NewGenerator(tt.prefix, "value")
+			generator.MetricPrefix = tt.prefix
+			generator.NameColumn = "name"
+
+			metricSet := metric.NewSet()
+			if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+				t.Fatalf("Failed to generate metrics: %v", err)
+			}
+
+			var buf bytes.Buffer
+			metricSet.WritePrometheus(&buf)
+			output := buf.String()
+
+			for _, expected := range tt.expected {
+				if !strings.Contains(output, expected) {
+					t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(output, unexpected) {
+					t.Errorf("Did not expect %q in output. Output:\n%s", unexpected, output)
+				}
+			}
+			if strings.Contains(output, " 5\n") || strings.Contains(output, " 6\n") {
+				t.Errorf("Rows without a valid name should be skipped. Output:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestMetricGenerationWithTypeAndHelp(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), "SELECT name, rows FROM tables")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("table_rows_total", "rows")
+	generator.Type = metric.TypeCounter
+	generator.Help = "Rows per table.\nCounted by the nightly job."
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+	metric.RecordQueryStatus(metricSet, "sql_query_status", metric.QueryLabel("table_rows", "SELECT 1"), nil)
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	output := buf.String()
+
+	expected := []string{
+		"# HELP sql_query_status Whether the query succeeded (1) or failed (0).\n# TYPE sql_query_status gauge\nsql_query_status{query_name=\"table_rows\"} 1\n",
+		"# HELP table_rows_total Rows per table.\\nCounted by the nightly job.\n# TYPE table_rows_total counter\ntable_rows_total{name=\"users\"} 1250\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(output, e) {
+			t.Errorf("Expected %q in output. Output:\n%s", e, output)
+		}
+	}
+}
+
+func TestParseMetricType(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected metric.MetricType
+		wantErr  bool
+	}{
+		{input: "", expected: metric.TypeGauge},
+		{input: "counter", expected: metric.TypeCounter},
+		{input: "Untyped", expected: metric.TypeUntyped},
+		{input: "histogram", expected: metric.TypeHistogram},
+		{input: "meter", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := metric.ParseMetricType(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMetricType(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseMetricType(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestRecordQueryStatus(t *testing.T) {
+	set := metric.NewSet()
+	metric.RecordQueryStatus(set, "sql_query_status", metric.QueryLabel("orders", "SELECT 1"), nil)
+	err := fmt.Errorf("failed to connect to database: dial tcp db.internal:5432: connect: connection refused")
+	metric.RecordQueryStatus(set, "sql_query_status", metric.QueryLabel("", "SELECT password FROM users"), err)
+
+	var buf bytes.Buffer
+	set.WritePrometheus(&buf)
+	output := buf.String()
+	for _, expected := range []string{
+		`sql_query_status{query_name="orders"} 1` + "\n",
+		`sql_query_status{query_hash="` + metric.QueryLabel("", "SELECT password FROM users").Value + `",error_type="connect"} 0` + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in output. Output:\n%s", expected, output)
+		}
+	}
+	for _, leaked := range []string{"db.internal", "password"} {
+		if strings.Contains(output, leaked) {
+			t.Errorf("Output contains %q. Output:\n%s", leaked, output)
+		}
+	}
+
+	if a, b := metric.QueryLabel("", "SELECT 1"), metric.QueryLabel("", "SELECT 2"); a.Value == b.Value || len(a.Value) != 16 {
+		t.Errorf("QueryLabel hashes = %q and %q, want distinct 16-digit hashes", a.Value, b.Value)
+	}
+}
+
+func TestMetricGenerationHistogram(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		name     string
+		query    string
+		setup    func(g *metric.Generator)
+		expected []string
+	}{
+		{
+			name: "Pre-aggregated buckets",
+			query: `SELECT 'api' AS route, 0.1 AS le, 5 AS count, 1.5 AS total
+				UNION ALL SELECT 'api', 0.5, 8, 1.5
+				UNION ALL SELECT 'api', '+Inf', 10, 1.5
+				UNION ALL SELECT 'web', 1, 3, NULL`,
+			setup: func(g *metric.Generator) {
+				g.ValueColumn = "count"
+				g.BucketColumn = "le"
+				g.SumColumn = "total"
+			},
+			expected: []string{
+				"# TYPE latency_seconds histogram\n",
+				`latency_seconds_bucket{route="api",le="0.1"} 5` + "\n" +
+					`latency_seconds_bucket{route="api",le="0.5"} 8` + "\n" +
+					`latency_seconds_bucket{route="api",le="+Inf"} 10` + "\n" +
+					`latency_seconds_sum{route="api"} 1.5` + "\n" +
+					`latency_seconds_count{route="api"} 10` + "\n",
+				`latency_seconds_bucket{route="web",le="1"} 3` + "\n" +
+					`latency_seconds_bucket{route="web",le="+Inf"} 3` + "\n" +
+					`latency_seconds_count{route="web"} 3` + "\n",
+			},
+		},
+		{
+			name: "Raw values",
+			query: `SELECT 'api' AS route, 0.25 AS value
+				UNION ALL SELECT 'api', 0.5
+				UNION ALL SELECT 'api', 2`,
+			setup: func(g *metric.Generator) {
+				g.Buckets = []float64{0.1, 0.5, 1}
+			},
+			expected: []string{
+				`latency_seconds_bucket{route="api",le="0.1"} 0` + "\n" +
+					`latency_seconds_bucket{route="api",le="0.5"} 2` + "\n" +
+					`latency_seconds_bucket{route="api",le="1"} 2` + "\n" +
+					`latency_seconds_bucket{route="api",le="+Inf"} 3` + "\n" +
+					`latency_seconds_sum{route="api"} 2.75` + "\n" +
+					`latency_seconds_count{route="api"} 3` + "\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := conn.ExecuteQuery(context.Background(), tc.query)
+			if err != nil {
+				t.Fatalf("Failed to execute query: %v", err)
+			}
+			defer rows.Close()
+
+			generator := metric.NewGenerator("latency_seconds", "value")
+			generator.Type = metric.TypeHistogram
+			tc.setup(generator)
+
+			metricSet := metric.NewSet()
+			if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+				t.Fatalf("Failed to generate metrics: %v", err)
+			}
+
+			var buf bytes.Buffer
+			metricSet.WritePrometheus(&buf)
+			output := buf.String()
+			for _, expected := range tc.expected {
+				if !strings.Contains(output, expected) {
+					t.Errorf("Expected %q in output. Output:\n%s", expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricGenerationSummary(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), `SELECT 'api' AS route, 1 AS value
+		UNION ALL SELECT 'api', 4 UNION ALL SELECT 'api', 3 UNION ALL SELECT 'api', 2`)
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("latency_seconds", "value")
+	generator.Type = metric.TypeSummary
+	generator.Quantiles = []float64{0.5, 0.9}
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	expected := "# TYPE latency_seconds summary\n" +
+		`latency_seconds{route="api",quantile="0.5"} 2` + "\n" +
+		`latency_seconds{route="api",quantile="0.9"} 4` + "\n" +
+		`latency_seconds_sum{route="api"} 10` + "\n" +
+		`latency_seconds_count{route="api"} 4` + "\n"
+	if output := buf.String(); !strings.Contains(output, expected) {
+		t.Errorf("Expected %q in output. Output:\n%s", expected, output)
+	}
+}
+
+func TestMetricGenerationHistogramNotCumulative(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), "SELECT 0.1 AS le, 5 AS value UNION ALL SELECT 0.5, 2")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("latency_seconds", "value")
+	generator.Type = metric.TypeHistogram
+	generator.BucketColumn = "le"
+
+	err = generator.GenerateFromRows(metric.NewSet(), rows)
+	if err == nil || !strings.Contains(err.Error(), "bucket counts are not cumulative") {
+		t.Errorf("Expected a non-cumulative bucket error, got %v", err)
+	}
+}
+
+func TestMetricGenerationWithTimestampColumn(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), `SELECT 'a' AS name, 1 AS value, 1700000000 AS ts
+		UNION ALL SELECT 'b', 2, 1700000000123
+		UNION ALL SELECT 'c', 3, '2023-11-14 22:13:20'
+		UNION ALL SELECT 'd', 4, NULL`)
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("measurement", "value")
+	generator.TimestampColumn = "ts"
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	output := buf.String()
+
+	expectedMetrics := []string{
+		"measurement{name=\"a\"} 1 1700000000000\n",
+		"measurement{name=\"b\"} 2 1700000000123\n",
+		"measurement{name=\"c\"} 3 1700000000000\n",
+		"measurement{name=\"d\"} 4\n",
+	}
+	for _, expected := range expectedMetrics {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, "ts=") {
+		t.Errorf("The timestamp column should not be a label. Output:\n%s", output)
+	}
+}
+
+func TestMetricGenerationLabelShaping(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		name     string
+		setup    func(g *metric.Generator)
+		expected string
+		wantErr  string
+	}{
+		{
+			name: "Rename, drop, constant labels and NULL placeholder",
+			setup: func(g *metric.Generator) {
+				g.RenameLabels = map[string]string{"name": "table"}
+				g.DropColumns = []string{"rows"}
+				g.ConstLabels = []metric.Label{{Name: "env", Value: "prod"}}
+				g.NullLabelValue = "unknown"
+			},
+			expected: `table_size{table="users",owner="unknown",env="prod"} 5120`,
+		},
+		{
+			name: "NULL label as empty string",
+			setup: func(g *metric.Generator) {
+				g.DropColumns = []string{"rows"}
+			},
+			expected: `table_size{name="users",owner=""} 5120`,
+		},
+		{
+			name: "Label allowlist",
+			setup: func(g *metric.Generator) {
+				g.LabelColumns = []string{"name"}
+			},
+			expected: `table_size{name="users"} 5120`,
+		},
+		{
+			name: "Label defined twice",
+			setup: func(g *metric.Generator) {
+				g.RenameLabels = map[string]string{"name": "env"}
+				g.ConstLabels = []metric.Label{{Name: "env", Value: "prod"}}
+			},
+			wantErr: "label 'env' of column 'name' is also defined by a constant label",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := conn.ExecuteQuery(context.Background(), "SELECT name, rows, NULL AS owner, size FROM tables")
+			if err != nil {
+				t.Fatalf("Failed to execute query: %v", err)
+			}
+			defer rows.Close()
+
+			generator := metric.NewGenerator("table_size", "size")
+			tc.setup(generator)
+
+			metricSet := metric.NewSet()
+			err = generator.GenerateFromRows(metricSet, rows)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to generate metrics: %v", err)
+			}
+
+			var buf bytes.Buffer
+			metricSet.WritePrometheus(&buf)
+			if output := buf.String(); !strings.Contains(output, tc.expected+"\n") {
+				t.Errorf("Expected metric %q not found in output. Output:\n%s", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestWritePrometheusEscaping(t *testing.T) {
+	testCases := []struct {
+		name     string
+		scheme   metric.NameScheme
+		expected []string
+	}{
+		{
+			name:   "Legacy names",
+			scheme: metric.LegacyNames,
+			expected: []string{
+				"# TYPE Row_Count gauge\n",
+				`Row_Count{table_name="a\"b\\c\nd é",_1st="x",_name__="y"} 1` + "\n",
+				`sql_query_status{query_hash="c46f0044c0a06ab6"} 1` + "\n",
+			},
+		},
+		{
+			name:   "UTF-8 names",
+			scheme: metric.UTF8Names,
+			expected: []string{
+				"# TYPE \"Row Count\" gauge\n",
+				`{"Row Count","table name"="a\"b\\c\nd é","1st"="x",_name__="y"} 1` + "\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			set := metric.NewSet()
+			set.SetNameScheme(tc.scheme)
+			set.Add("Row Count", []metric.Label{
+				{Name: "table name", Value: "a\"b\\c\nd é"},
+				{Name: "1st", Value: "x"},
+				{Name: "__name__", Value: "y"},
+			}, 1)
+			metric.RecordQueryStatus(set, "sql_query_status", metric.QueryLabel("", `SELECT "Row Count" FROM t`), nil)
+
+			var buf bytes.Buffer
+			set.WritePrometheus(&buf)
+			output := buf.String()
+			for _, expected := range tc.expected {
+				if !strings.Contains(output, expected) {
+					t.Errorf("Expected %q in output. Output:\n%s", expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricGenerationWithColumnAliases(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), `SELECT name AS "Table Name", rows AS "Row Count" FROM tables`)
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("tbl", "")
+	generator.ValueColumns = []metric.ValueColumn{{Column: "Row Count"}}
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	expected := `tbl_Row_Count{Table_Name="users"} 1250`
+	if output := buf.String(); !strings.Contains(output, expected) {
+		t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+	}
+}
+
+func TestMetricGenerationDuplicateSeries(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		policy   metric.DuplicatePolicy
+		expected string
+		wantErr  string
+	}{
+		{policy: metric.DuplicateError, wantErr: `duplicate series dup{name="a"}`},
+		{policy: metric.DuplicateLast, expected: `dup{name="a"} 3`},
+		{policy: metric.DuplicateFirst, expected: `dup{name="a"} 1`},
+		{policy: metric.DuplicateSum, expected: `dup{name="a"} 9`},
+		{policy: metric.DuplicateMax, expected: `dup{name="a"} 5`},
+		{policy: metric.DuplicateMin, expected: `dup{name="a"} 1`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			rows, err := conn.ExecuteQuery(context.Background(), `SELECT 'a' AS name, 1 AS value
+				UNION ALL SELECT 'a', 5 UNION ALL SELECT 'a', 3 UNION ALL SELECT 'b', 7`)
+			if err != nil {
+				t.Fatalf("Failed to execute query: %v", err)
+			}
+			defer rows.Close()
+
+			generator := metric.NewGenerator("dup", "value")
+			generator.OnDuplicate = tc.policy
+
+			metricSet := metric.NewSet()
+			err = generator.GenerateFromRows(metricSet, rows)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.wantErr, err)
+				}
+				if generator.Duplicates != 1 {
+					t.Errorf("Expected 1 duplicate, got %d", generator.Duplicates)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to generate metrics: %v", err)
+			}
+			if generator.Duplicates != 2 {
+				t.Errorf("Expected 2 duplicates, got %d", generator.Duplicates)
+			}
+
+			var buf bytes.Buffer
+			metricSet.WritePrometheus(&buf)
+			output := buf.String()
+			for _, expected := range []string{tc.expected + "\n", `dup{name="b"} 7` + "\n"} {
+				if !strings.Contains(output, expected) {
+					t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricGenerationTypedColumns(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	_, err := conn.DB.Exec(`
+		CREATE TABLE typed_values (
+			name TEXT,
+			flag BOOLEAN,
+			seen_at DATETIME,
+			amount DECIMAL(10,2),
+			elapsed INTERVAL
+		);
+		INSERT INTO typed_values (name, flag, seen_at, amount, elapsed) VALUES
+		('a', 1, '2024-01-02 03:04:05', '123.45', '1 day 02:00:00'),
+		('b', 0, '2024-01-02 03:04:05', 'broken', '-00:00:30'),
+		('c', NULL, NULL, NULL, NULL)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create typed_values table: %v", err)
+	}
+
+	rows, err := conn.ExecuteQuery(context.Background(), "SELECT name, flag, seen_at, amount, elapsed FROM typed_values")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("typed", "")
+	generator.ValueColumns, _ = metric.ParseValueColumns("flag,seen_at,amount,elapsed")
+	generator.NullValue = metric.NullNaN
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+	if generator.SkippedRows != 1 {
+		t.Errorf("Expected 1 skipped row, got %d", generator.SkippedRows)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	output := buf.String()
+	expectedMetrics := []string{
+		`typed_flag{name="a"} 1`,
+		`typed_flag{name="b"} 0`,
+		`typed_flag{name="c"} NaN`,
+		`typed_seen_at{name="a"} 1704164645`,
+		`typed_amount{name="a"} 123.45`,
+		`typed_amount{name="c"} NaN`,
+		`typed_elapsed{name="a"} 93600`,
+		`typed_elapsed{name="b"} -30`,
+	}
+	for _, expected := range expectedMetrics {
+		if !strings.Contains(output, expected+"\n") {
+			t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, `typed_amount{name="b"}`) {
+		t.Errorf("Value that cannot be converted should be skipped. Output:\n%s", output)
+	}
+}
+
+func TestParseNullPolicy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected metric.NullPolicy
+		wantErr  bool
+	}{
+		{input: "", expected: metric.NullSkip},
+		{input: "zero", expected: metric.NullZero},
+		{input: "NaN", expected: metric.NullNaN},
+		{input: "drop", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := metric.ParseNullPolicy(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseNullPolicy(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseNullPolicy(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestMetricGenerationInfoMode(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), "SELECT name, rows FROM tables ORDER BY name")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("table_info", "")
+	generator.Mode = metric.ModeInfo
+	generator.ConstLabels = []metric.Label{{Name: "env", Value: "test"}}
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	output := buf.String()
+	expectedMetrics := []string{
+		"# TYPE table_info gauge\n",
+		`table_info{name="categories",rows="50",env="test"} 1` + "\n",
+		`table_info{name="users",rows="1250",env="test"} 1` + "\n",
+	}
+	for _, expected := range expectedMetrics {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+		}
+	}
+}
+
+func TestMetricGenerationRowCountMode(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	rows, err := conn.ExecuteQuery(context.Background(), "SELECT name FROM tables")
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	generator := metric.NewGenerator("table_count", "")
+	generator.Mode = metric.ModeRowCount
+	generator.Help = "Number of tables."
+
+	metricSet := metric.NewSet()
+	if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+		t.Fatalf("Failed to generate metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	expected := "# HELP table_count Number of tables.\n# TYPE table_count gauge\ntable_count 4\n"
+	if buf.String() != expected {
+		t.Errorf("Expected output %q, got %q", expected, buf.String())
+	}
+}
+
+func TestGeneratorValidateMode(t *testing.T) {
+	testCases := []struct {
+		name      string
+		generator metric.Generator
+		wantErr   string
+	}{
+		{name: "info", generator: metric.Generator{Mode: metric.ModeInfo, TimestampColumn: "ts"}},
+		{name: "row count", generator: metric.Generator{Mode: metric.ModeRowCount, Type: metric.TypeCounter}},
+		{
+			name:      "info with value columns",
+			generator: metric.Generator{Mode: metric.ModeInfo, ValueColumns: []metric.ValueColumn{{Column: "a"}}},
+			wantErr:   "value columns cannot be used in info mode",
+		},
+		{
+			name:      "row count histogram",
+			generator: metric.Generator{Mode: metric.ModeRowCount, Type: metric.TypeHistogram, Buckets: []float64{1}},
+			wantErr:   "metric type histogram cannot be used in row_count mode",
+		},
+		{
+			name:      "row count with name column",
+			generator: metric.Generator{Mode: metric.ModeRowCount, NameColumn: "name"},
+			wantErr:   "name and timestamp columns cannot be used in row_count mode",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.generator.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("Expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMetricGenerationWideMode(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		name         string
+		query        string
+		valueColumns string
+		labelColumns string
+		expected     []string
+		unexpected   []string
+	}{
+		{
+			name:  "numeric columns become metrics",
+			query: "SELECT name, rows, size FROM tables WHERE name = 'users'",
+			expected: []string{
+				`table_rows{name="users"} 1250`,
+				`table_size{name="users"} 5120`,
+			},
+		},
+		{
+			name:         "label column override",
+			query:        "SELECT name, rows, size FROM tables WHERE name = 'users'",
+			labelColumns: "name,size",
+			expected:     []string{`table_rows{name="users",size="5120"} 1250`},
+			unexpected:   []string{"table_size"},
+		},
+		{
+			name:         "value column override",
+			query:        "SELECT name, decimal_val, value FROM special_types_table WHERE name = 'item1'",
+			valueColumns: "decimal_val:table_decimal",
+			expected: []string{
+				`table_decimal{name="item1"} 123.456`,
+				`table_value{name="item1"} 1`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := conn.ExecuteQuery(context.Background(), tc.query)
+			if err != nil {
+				t.Fatalf("Failed to execute query: %v", err)
+			}
+			defer rows.Close()
+
+			generator := metric.NewGenerator("table", "")
+			generator.Mode = metric.ModeWide
+			generator.ValueColumns, _ = metric.ParseValueColumns(tc.valueColumns)
+			generator.LabelColumns = metric.ParseColumnList(tc.labelColumns)
+
+			metricSet := metric.NewSet()
+			if err := generator.GenerateFromRows(metricSet, rows); err != nil {
+				t.Fatalf("Failed to generate metrics: %v", err)
+			}
+
+			var buf bytes.Buffer
+			metricSet.WritePrometheus(&buf)
+			output := buf.String()
+			for _, expected := range tc.expected {
+				if !strings.Contains(output, expected+"\n") {
+					t.Errorf("Expected metric %q not found in output. Output:\n%s", expected, output)
+				}
+			}
+			for _, unexpected := range tc.unexpected {
+				if strings.Contains(output, unexpected) {
+					t.Errorf("Unexpected %q found in output. Output:\n%s", unexpected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamFromRows(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+	constLabels := []metric.Label{{Name: "env", Value: "test"}}
+
+	query := "SELECT name, value FROM metrics"
+	rows, err := conn.ExecuteQuery(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	generator := metric.NewGenerator("test_metric", "value")
+	generator.Help = "Test metric."
+	set := metric.NewSet()
+	set.SetConstLabels(constLabels)
+	err = generator.GenerateFromRows(set, rows)
+	rows.Close()
+	if err != nil {
+		t.Fatalf("GenerateFromRows() error = %v", err)
+	}
+	var buffered bytes.Buffer
+	set.WritePrometheus(&buffered)
+
+	rows, err = conn.ExecuteQuery(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Failed to execute query: %v", err)
+	}
+	defer rows.Close()
+	var streamed bytes.Buffer
+	enc := metric.NewEncoder(&streamed)
+	enc.SetConstLabels(constLabels)
+	if err := generator.StreamFromRows(enc, rows); err != nil {
+		t.Fatalf("StreamFromRows() error = %v", err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if streamed.String() != buffered.String() {
+		t.Errorf("Streamed output differs from buffered output.\nStreamed:\n%s\nBuffered:\n%s", streamed.String(), buffered.String())
+	}
+	if enc.Len() != set.Len() {
+		t.Errorf("Encoder wrote %d series, want %d", enc.Len(), set.Len())
+	}
+}
+
+func TestStreamFromRowsDuplicatesAndLimits(t *testing.T) {
+	conn, _, cleanup := tests.SetupTestDB(t)
+	defer cleanup()
+	query := `SELECT 'a' AS name, 1 AS value UNION ALL SELECT 'b', 2 UNION ALL SELECT 'a', 3 UNION ALL SELECT 'c', 4`
+
+	testCases := []struct {
+		name          string
+		policy        metric.DuplicatePolicy
+		maxSeries     int
+		expected      string
+		wantErr       string
+		wantTruncated string
+	}{
+		{name: "first", policy: metric.DuplicateFirst, expected: "# TYPE dup gauge\ndup{name=\"a\"} 1\ndup{name=\"b\"} 2\ndup{name=\"c\"} 4\n"},
+		{name: "error", policy: metric.DuplicateError, expected: "# TYPE dup gauge\ndup{name=\"a\"} 1\ndup{name=\"b\"} 2\n", wantErr: `duplicate series dup{name="a"}`},
+		{name: "max_series", policy: metric.DuplicateFirst, maxSeries: 2, expected: "# TYPE dup gauge\ndup{name=\"a\"} 1\ndup{name=\"b\"} 2\n", wantTruncated: metric.LimitMaxSeries},
+		{name: "sum", policy: metric.DuplicateSum, wantErr: "duplicate policy sum cannot be streamed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := conn.ExecuteQuery(context.Background(), query)
+			if err != nil {
+				t.Fatalf("Failed to execute query: %v", err)
+			}
+			defer rows.Close()
+
+			generator := metric.NewGenerator("dup", "value")
+			generator.OnDuplicate = tc.policy
+			var buf bytes.Buffer
+			enc := metric.NewEncoder(&buf)
+			enc.SetLimits(tc.maxSeries, 0)
+			err = generator.StreamFromRows(enc, rows)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("StreamFromRows() error = %v", err)
+			}
+			enc.Flush()
+
+			if buf.String() != tc.expected {
+				t.Errorf("Output = %q, want %q", buf.String(), tc.expected)
+			}
+			if got := enc.Truncated(); got != tc.wantTruncated {
+				t.Errorf("Truncated() = %q, want %q", got, tc.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestGeneratorCheckStreamable(t *testing.T) {
+	testCases := []struct {
+		name    string
+		setup   func(g *metric.Generator)
+		wantErr string
+	}{
+		{name: "value", setup: func(g *metric.Generator) {}},
+		{name: "info", setup: func(g *metric.Generator) { g.Mode = metric.ModeInfo }},
+		{name: "row count", setup: func(g *metric.Generator) { g.Mode = metric.ModeRowCount }},
+		{name: "single value column", setup: func(g *metric.Generator) { g.ValueColumns = []metric.ValueColumn{{Column: "size"}} }},
+		{name: "first", setup: func(g *metric.Generator) { g.OnDuplicate = metric.DuplicateFirst }},
+		{name: "histogram", setup: func(g *metric.Generator) { g.Type = metric.TypeHistogram }, wantErr: "histogram metrics cannot be streamed"},
+		{name: "value columns", setup: func(g *metric.Generator) {
+			g.ValueColumns = []metric.ValueColumn{{Column: "size"}, {Column: "rows"}}
+		}, wantErr: "several value columns cannot be streamed"},
+		{name: "wide", setup: func(g *metric.Generator) { g.Mode = metric.ModeWide }, wantErr: "several value columns cannot be streamed"},
+		{name: "name column", setup: func(g *metric.Generator) { g.NameColumn = "name" }, wantErr: "a name column cannot be streamed"},
+		{name: "last", setup: func(g *metric.Generator) { g.OnDuplicate = metric.DuplicateLast }, wantErr: "duplicate policy last cannot be streamed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			generator := metric.NewGenerator("test", "value")
+			tc.setup(generator)
+			err := generator.CheckStreamable()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckStreamable() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("CheckStreamable() error = %v, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// benchmarkRows is the number of rows of the table the generation benchmarks read.
+const benchmarkRows = 100000
+
+// firstByteWriter discards what is written to it and records when the first byte arrived.
+type firstByteWriter struct {
+	first time.Time
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	if w.first.IsZero() {
+		w.first = time.Now()
+	}
+	return len(p), nil
+}
+
+// benchmarkGeneration generates metrics from a large table, buffered with a Set or streamed
+// with an Encoder. Besides the usual figures it reports the time to the first byte of output
+// and the heap still in use once all rows are read, which is what a scrape holds at its peak.
+func benchmarkGeneration(b *testing.B, stream bool) {
+	conn, _, cleanup := tests.SetupTestDB(b)
+	defer cleanup()
+	tests.CreateLargeTable(b, conn.DB, "large_table", benchmarkRows)
+
+	var firstByte time.Duration
+	var liveBytes uint64
+	var mem runtime.MemStats
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&mem)
+		baseline := mem.HeapAlloc
+		b.StartTimer()
+
+		start := time.Now()
+		rows, err := conn.ExecuteQuery(context.Background(), "SELECT name, value FROM large_table")
+		if err != nil {
+			b.Fatalf("Failed to execute query: %v", err)
+		}
+		generator := metric.NewGenerator("bench", "value")
+		w := &firstByteWriter{}
+		var set *metric.Set
+		var enc *metric.Encoder
+		if stream {
+			enc = metric.NewEncoder(w)
+			err = generator.StreamFromRows(enc, rows)
+		} else {
+			set = metric.NewSet()
+			err = generator.GenerateFromRows(set, rows)
+		}
+		rows.Close()
+		if err != nil {
+			b.Fatalf("Failed to generate metrics: %v", err)
+		}
+
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&mem)
+		if mem.HeapAlloc > baseline {
+			liveBytes += mem.HeapAlloc - baseline
+		}
+		b.StartTimer()
+
+		if stream {
+			enc.Flush()
+		} else {
+			set.WritePrometheus(w)
+		}
+		firstByte += w.first.Sub(start)
+	}
+	b.ReportMetric(float64(firstByte.Nanoseconds())/float64(b.N), "ns-to-first-byte/op")
+	b.ReportMetric(float64(liveBytes)/float64(b.N), "live-B/op")
+}
+
+func BenchmarkGenerateFromRows(b *testing.B) {
+	benchmarkGeneration(b, false)
+}
+
+func BenchmarkStreamFromRows(b *testing.B) {
+	benchmarkGeneration(b, true)
+}
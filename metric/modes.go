@@ -0,0 +1,101 @@
+package metric
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	dberrors "job_runner/errors"
+)
+
+// Mode decides how result rows are turned into samples.
+type Mode string
+
+// Supported generator modes.
+const (
+	ModeValue    Mode = "value"     // Samples take their values from the value column(s)
+	ModeInfo     Mode = "info"      // One sample per row with the value 1 and every column as a label
+	ModeRowCount Mode = "row_count" // A single sample holding the number of rows
+	ModeWide     Mode = "wide"      // One metric per column of a numeric type, the other columns are labels
+)
+
+// ParseMode parses a generator mode name. An empty string means value.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(s)); m {
+	case "":
+		return ModeValue, nil
+	case ModeValue, ModeInfo, ModeRowCount, ModeWide:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported mode %q (supported: info, row_count, value, wide)", s)
+	}
+}
+
+// validateMode checks that the settings of the generator apply to its mode.
+func (g *Generator) validateMode() error {
+	if g.Mode != ModeInfo && g.Mode != ModeRowCount {
+		return nil
+	}
+	switch {
+	case len(g.ValueColumns) > 0:
+		return fmt.Errorf("value columns cannot be used in %s mode", g.Mode)
+	case g.Type == TypeHistogram || g.Type == TypeSummary:
+		return fmt.Errorf("metric type %s cannot be used in %s mode", g.Type, g.Mode)
+	case g.Mode == ModeRowCount && (g.NameColumn != "" || g.TimestampColumn != ""):
+		return fmt.Errorf("name and timestamp columns cannot be used in %s mode", g.Mode)
+	}
+	return nil
+}
+
+// generateRowCount adds a single sample named after the prefix that holds the number of rows.
+// It carries only the constant labels.
+func (g *Generator) generateRowCount(out sink, rows *sql.Rows) error {
+	var count float64
+	for rows.Next() && g.readMore(out, int(count)) {
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return dberrors.WrapQueryError(err, "error iterating rows")
+	}
+	out.Describe(g.MetricPrefix, g.metricType(), g.Help)
+	out.AddAt(g.MetricPrefix, g.ConstLabels, count, time.Time{})
+	return nil
+}
+
+// resolveWideColumns finds the value columns of wide mode: every column of a numeric, boolean,
+// date/time or interval type, in result column order. Columns listed in ValueColumns are value
+// columns whatever their type; columns listed in LabelColumns or DropColumns and the special
+// columns never are. Metrics are named <prefix>_<column> unless ValueColumns gives a name.
+func (g *Generator) resolveWideColumns(columns []string, kinds []columnKind) ([]resolvedValueColumn, error) {
+	for _, vc := range g.ValueColumns {
+		if _, err := findValueColumn(columns, vc.Column); err != nil {
+			return nil, err
+		}
+	}
+	notValues := append([]string{g.NameColumn, g.TimestampColumn, g.BucketColumn, g.SumColumn}, g.LabelColumns...)
+	notValues = append(notValues, g.DropColumns...)
+
+	var list []ValueColumn
+	for i, col := range columns {
+		if vc, ok := findValueColumnSpec(g.ValueColumns, col); ok {
+			list = append(list, vc)
+		} else if kinds[i] != kindOther && findColumn(notValues, col) == -1 {
+			list = append(list, ValueColumn{Column: col})
+		}
+	}
+	if len(list) == 0 {
+		return nil, dberrors.NewQueryError("no numeric columns found in result set")
+	}
+	return g.resolveListedValueColumns(columns, list)
+}
+
+// findValueColumnSpec returns the value column of list that names column (case-insensitive).
+func findValueColumnSpec(list []ValueColumn, column string) (ValueColumn, bool) {
+	for _, vc := range list {
+		if strings.EqualFold(vc.Column, column) {
+			return vc, true
+		}
+	}
+	return ValueColumn{}, false
+}
@@ -0,0 +1,103 @@
+package metric
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// NameScheme selects how metric and label names that are not valid classic Prometheus names,
+// such as column aliases like "Row Count", are exposed.
+type NameScheme int
+
+const (
+	// LegacyNames replaces every character that is not allowed with an underscore, so that names
+	// match [a-zA-Z_:][a-zA-Z0-9_:]* (metrics) and [a-zA-Z_][a-zA-Z0-9_]* (labels).
+	LegacyNames NameScheme = iota
+	// UTF8Names keeps any UTF-8 name and quotes names that are not valid legacy names,
+	// as supported by Prometheus 3.0 and later.
+	UTF8Names
+)
+
+// metricName returns name as it is exposed under the scheme.
+func (ns NameScheme) metricName(name string) string {
+	if ns == UTF8Names {
+		return strings.ToValidUTF8(name, "_")
+	}
+	name = sanitizeMetricName(name)
+	if name == "" || isASCIIDigit(name[0]) {
+		name = "_" + name
+	}
+	return name
+}
+
+// labelName returns name as it is exposed under the scheme. Names starting with "__" are
+// reserved for internal use by Prometheus and are reduced to a single leading underscore.
+func (ns NameScheme) labelName(name string) string {
+	if ns == UTF8Names {
+		name = strings.ToValidUTF8(name, "_")
+	} else {
+		name = strings.ReplaceAll(sanitizeMetricName(name), ":", "_")
+		if name == "" || isASCIIDigit(name[0]) {
+			name = "_" + name
+		}
+	}
+	if strings.HasPrefix(name, "__") {
+		name = "_" + strings.TrimLeft(name, "_")
+	}
+	return name
+}
+
+// sanitizeMetricName replaces every character that is not allowed in a metric name with an underscore.
+func sanitizeMetricName(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if r == '_' || r == ':' || r < 128 && (isASCIILetter(byte(r)) || isASCIIDigit(byte(r))) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// isLegacyName reports whether name is a valid legacy metric name, or label name if colons are not allowed.
+func isLegacyName(name string, allowColon bool) bool {
+	if name == "" || isASCIIDigit(name[0]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '_' && !(c == ':' && allowColon) && !isASCIILetter(c) && !isASCIIDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteName returns name unchanged if it is a valid legacy name, and as a quoted string otherwise.
+func quoteName(name string, allowColon bool) string {
+	if isLegacyName(name, allowColon) {
+		return name
+	}
+	return `"` + escapeLabelValue(name) + `"`
+}
+
+// escapeLabelValue escapes a label value for the text exposition format: backslash, double quote
+// and line feed are the only characters escaped; everything else is written as UTF-8.
+func escapeLabelValue(s string) string {
+	if !strings.ContainsAny(s, "\\\"\n") && utf8.ValidString(s) {
+		return s
+	}
+	return labelValueEscaper.Replace(strings.ToValidUTF8(s, "�"))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isASCIIDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,186 @@
+package metric
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"strings"
+	"time"
+)
+
+// sink receives the samples a Generator produces: a Set, or an Encoder when streaming.
+type sink interface {
+	Describe(name string, typ MetricType, help string)
+	AddAt(name string, labels []Label, value float64, ts time.Time)
+	AddSample(name, suffix string, labels []Label, value float64, ts time.Time)
+	Get(name string, labels []Label) (float64, bool)
+	Truncated() string
+	truncate(limit string)
+	stopped() bool
+	nameScheme() NameScheme
+}
+
+// Encoder writes samples in the Prometheus text exposition format as they are added, instead
+// of collecting them like a Set. Only a hash of every series is kept, to detect duplicates,
+// so memory use does not grow with the size of the output. The # HELP and # TYPE lines of a
+// family are written before its first sample, which means that the samples of a family must
+// be added consecutively. An Encoder is not safe for concurrent use.
+type Encoder struct {
+	naming
+	limiter
+	w        *bufio.Writer
+	families map[string]*encodedFamily
+	seen     map[uint64]struct{} // Hashes of the series written
+	seed     maphash.Seed
+	count    int // Number of series written
+	written  int // Number of bytes written
+	line     strings.Builder
+	err      error // First write error
+}
+
+// encodedFamily is the metadata of a family written by an Encoder.
+type encodedFamily struct {
+	help    string
+	typ     MetricType
+	started bool // The # TYPE line has been written
+}
+
+// NewEncoder creates an Encoder that writes to w. Output is buffered; call Flush when done.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:        bufio.NewWriter(w),
+		families: make(map[string]*encodedFamily),
+		seen:     make(map[uint64]struct{}),
+		seed:     maphash.MakeSeed(),
+	}
+}
+
+// Describe sets the type and HELP text of a metric family. It has no effect once the
+// first sample of the family has been written. An empty help keeps the current text.
+func (e *Encoder) Describe(name string, typ MetricType, help string) {
+	f := e.family(e.scheme.metricName(name))
+	f.typ = typ
+	if help != "" {
+		f.help = help
+	}
+}
+
+// Add writes the sample identified by name and labels.
+// Families that have not been described are exposed as gauges.
+// If the series has already been written, the sample is dropped.
+func (e *Encoder) Add(name string, labels []Label, value float64) {
+	e.AddSample(name, "", labels, value, time.Time{})
+}
+
+// AddAt is like Add with an explicit sample timestamp.
+func (e *Encoder) AddAt(name string, labels []Label, value float64, ts time.Time) {
+	e.AddSample(name, "", labels, value, ts)
+}
+
+// AddSample is like AddAt for a sample named name+suffix that belongs to the family name.
+// A zero ts writes the sample without a timestamp. A new series beyond the series limit is
+// dropped; once the byte limit is exceeded or a write has failed, all samples are dropped.
+func (e *Encoder) AddSample(name, suffix string, labels []Label, value float64, ts time.Time) {
+	if e.err != nil || e.truncated == LimitMaxResponseBytes {
+		return
+	}
+	name = e.scheme.metricName(name)
+	formatted := e.seriesLabels(labels)
+	hash := e.seriesHash(name, suffix, formatted)
+	if _, ok := e.seen[hash]; ok {
+		return
+	}
+	if e.maxSeries > 0 && e.count >= e.maxSeries {
+		e.truncate(LimitMaxSeries)
+		return
+	}
+
+	f := e.family(name)
+	e.line.Reset()
+	if !f.started {
+		e.line.WriteString(formatHeader(name, f.help, f.typ))
+	}
+	writeSample(&e.line, name+suffix, formatted, value, ts)
+	if e.maxBytes > 0 && e.written+e.line.Len() > e.maxBytes {
+		e.truncate(LimitMaxResponseBytes)
+		return
+	}
+	if _, err := e.w.WriteString(e.line.String()); err != nil {
+		e.err = err
+		return
+	}
+	f.started = true
+	e.seen[hash] = struct{}{}
+	e.count++
+	e.written += e.line.Len()
+}
+
+// Get reports whether the series identified by name and labels has been written.
+// Written values are not kept, so the returned value is always 0.
+func (e *Encoder) Get(name string, labels []Label) (float64, bool) {
+	name = e.scheme.metricName(name)
+	_, ok := e.seen[e.seriesHash(name, "", e.seriesLabels(labels))]
+	return 0, ok
+}
+
+// Len returns the number of samples written.
+func (e *Encoder) Len() int {
+	return e.count
+}
+
+// Flush writes any buffered output and returns the first write error, if any.
+func (e *Encoder) Flush() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.w.Flush()
+	return e.err
+}
+
+// stopped reports whether samples are dropped because a limit was exceeded or a write failed.
+func (e *Encoder) stopped() bool {
+	return e.err != nil || e.truncated != ""
+}
+
+// family returns the named family, creating it as a gauge if needed.
+func (e *Encoder) family(name string) *encodedFamily {
+	f, ok := e.families[name]
+	if !ok {
+		f = &encodedFamily{typ: TypeGauge}
+		e.families[name] = f
+	}
+	return f
+}
+
+// seriesHash returns the hash a series is remembered by. With 64 bits, a collision that
+// makes a series look like a duplicate is negligible even for millions of series.
+func (e *Encoder) seriesHash(name, suffix, labels string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(e.seed)
+	h.WriteString(name)
+	h.WriteByte(0)
+	h.WriteString(suffix)
+	h.WriteByte('{')
+	h.WriteString(labels)
+	return h.Sum64()
+}
+
+// CheckStreamable returns an error explaining why the generator cannot stream its samples
+// with StreamFromRows, or nil if it can. A streamed sample is written as soon as its row is
+// read, so every family must be complete before the next one starts and duplicates can be
+// detected but not merged: histograms, summaries, several value columns, a name column and
+// duplicate policies other than error and first cannot be streamed.
+func (g *Generator) CheckStreamable() error {
+	switch {
+	case g.Type == TypeHistogram || g.Type == TypeSummary:
+		return fmt.Errorf("%s metrics cannot be streamed", g.Type)
+	case g.Mode == ModeWide || (g.Mode != ModeInfo && g.Mode != ModeRowCount && len(g.ValueColumns) > 1):
+		return fmt.Errorf("several value columns cannot be streamed")
+	case g.NameColumn != "" && g.Mode != ModeRowCount:
+		return fmt.Errorf("a name column cannot be streamed")
+	case g.OnDuplicate != "" && g.OnDuplicate != DuplicateError && g.OnDuplicate != DuplicateFirst:
+		return fmt.Errorf("duplicate policy %s cannot be streamed (supported: error, first)", g.OnDuplicate)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dberrors "job_runner/errors"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header that carries the id of a task request. A valid id sent by the
+// client is kept, otherwise one is generated; the response always carries it.
+const RequestIDHeader = "X-Request-Id"
+
+// problemTypePrefix is the prefix of the type URI of problem responses, followed by the error code.
+const problemTypePrefix = "urn:job_runner:error:"
+
+// problem is a problem details response (RFC 9457) describing a failed task request.
+type problem struct {
+	Type      string        `json:"type"`
+	Title     string        `json:"title"`
+	Status    int           `json:"status"`
+	Detail    string        `json:"detail"`
+	Code      dberrors.Code `json:"code"`
+	Retryable bool          `json:"retryable"`
+	Task      string        `json:"task"`
+	RequestID string        `json:"request_id"`
+}
+
+// ensureRequestID sets the request id header of the response: the one sent by the client if
+// it is valid, or a new one. It returns the id.
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// validRequestID reports whether a client-supplied request id can be used as-is: it must be
+// short and consist of printable ASCII characters other than spaces, so that it is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsJSON reports whether the client asked for a JSON response in its Accept header.
+// Prometheus never does, so scrapes keep getting the exposition format.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			if mediaType == "application/json" || mediaType == "application/problem+json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeProblem writes err as a problem details response with the given status code.
+func writeProblem(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	code := dberrors.CodeOf(err)
+	body, marshalErr := json.Marshal(problem{
+		Type:      problemTypePrefix + string(code),
+		Title:     code.Title(),
+		Status:    statusCode,
+		Detail:    err.Error(),
+		Code:      code,
+		Retryable: dberrors.IsRetryable(err),
+		Task:      strings.TrimPrefix(r.URL.Path, "/"),
+		RequestID: w.Header().Get(RequestIDHeader),
+	})
+	if marshalErr != nil {
+		http.Error(w, marshalErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	w.Write(append(body, '\n'))
+}
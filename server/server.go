@@ -6,11 +6,15 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"reflect"
 	"strconv" // Added for converting status code to string
 	"sync"    // Added for mutex
 	"time"
 
 	"job_runner/config"
+	"job_runner/db"
+	dberrors "job_runner/errors"
+	"job_runner/redact"
 	"job_runner/tasks"
 	"job_runner/tasks/httpcheck"
 	"job_runner/tasks/sql"
@@ -38,6 +42,24 @@ var (
 		},
 		[]string{"code", "handler", "method"}, // Order changed to code, handler, method
 	)
+
+	// taskCacheRequestsTotal counts requests for cacheable task output by whether the cache had it.
+	taskCacheRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "task_cache_requests_total",
+			Help: "Total number of task requests with caching enabled, by result (hit or miss).",
+		},
+		[]string{"result"},
+	)
+
+	// taskCoalescedRequestsTotal counts requests that shared the execution of an identical request.
+	taskCoalescedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "task_coalesced_requests_total",
+			Help: "Total number of task requests that shared the execution of an identical concurrent request.",
+		},
+		[]string{"handler"},
+	)
 )
 
 // responseData is a wrapper for http.ResponseWriter to capture status code
@@ -84,6 +106,9 @@ type Server struct {
 	server       *http.Server
 	taskHandlers map[string]tasks.TaskHandler // Map routes to task handlers
 	configLock   sync.RWMutex                 // Added for thread-safe config access
+	dbPool       *db.Pool                     // Database connections shared by SQL tasks
+	cache        *tasks.Cache                 // Outputs of cacheable tasks
+	inflight     *tasks.Coalescer             // Task executions shared by identical requests
 }
 
 // New creates a new server instance
@@ -92,10 +117,13 @@ func New(cfg config.Config, configFile string) *Server { // Added configFile par
 		Config:       cfg,
 		configFile:   configFile, // Store the config file path
 		taskHandlers: make(map[string]tasks.TaskHandler),
+		dbPool:       db.NewPool(cfg.PoolIdleTimeout.ToStd(), cfg.MaxPools),
+		cache:        tasks.NewCache(),
+		inflight:     tasks.NewCoalescer(),
 	}
 
 	// Initialize task handlers
-	s.taskHandlers["/sql"] = sql.NewSQLTaskHandler()
+	s.taskHandlers["/sql"] = sql.NewSQLTaskHandler(s.dbPool)
 	s.taskHandlers["/http_check"] = httpcheck.NewHTTPCheckTaskHandler() // Add new handler
 
 	return s
@@ -142,18 +170,115 @@ func (s *Server) Start() error {
 }
 
 // genericTaskDispatcher handles requests by calling the appropriate TaskHandler.
+// A CacheableTaskHandler may be answered from the cache, and a StreamingTaskHandler may write
+// the response itself unless its output is cached. Identical concurrent requests share one
+// execution of the task. Every response carries the request id.
 func (s *Server) genericTaskDispatcher(w http.ResponseWriter, r *http.Request, handler tasks.TaskHandler) {
+	ensureRequestID(w, r)
+
 	s.configLock.RLock()
 	currentConfig := s.Config
 	s.configLock.RUnlock()
-	metricContent, statusCode, err := handler.Handle(r.Context(), r, currentConfig)
+
+	if ch, ok := handler.(tasks.CacheableTaskHandler); ok {
+		policy, err := ch.CachePolicy(r, currentConfig)
+		if err != nil {
+			writeTaskResponse(w, r, nil, dberrors.HTTPStatus(err), err)
+			return
+		}
+		if policy.TTL > 0 {
+			metricContent, statusCode, err := s.handleCached(r, ch, policy, currentConfig)
+			writeTaskResponse(w, r, metricContent, statusCode, err)
+			return
+		}
+	}
+
+	result := s.coalesce(r, func(ctx context.Context, allowStream bool) tasks.Result {
+		if sh, ok := handler.(tasks.StreamingTaskHandler); ok && allowStream {
+			streamed, metricContent, statusCode, err := sh.HandleStream(ctx, w, r, currentConfig)
+			return tasks.Result{Content: metricContent, StatusCode: statusCode, Err: err, Streamed: streamed}
+		}
+		metricContent, statusCode, err := handler.Handle(ctx, r, currentConfig)
+		return tasks.Result{Content: metricContent, StatusCode: statusCode, Err: err}
+	})
+	if result.Streamed {
+		// The response has been written; a later error is reported by the status metrics
+		if result.Err != nil {
+			slog.Error("Task handler error while streaming", "path", r.URL.Path, "method", r.Method, "request_id", w.Header().Get(RequestIDHeader), "error", redact.String(result.Err.Error()))
+		}
+		return
+	}
 
 	// s.incrementRequestCounter(r.URL.Path, r.Method, statusCode) // This is now handled by MetricsMiddleware
 
+	writeTaskResponse(w, r, result.Content, result.StatusCode, result.Err)
+}
+
+// coalesce runs the task execution fn for the request, sharing it with identical concurrent
+// GET requests. fn may stream its output to the response if allowStream is set. The output of
+// an execution streamed to another response cannot be shared, so the requests that waited for
+// it share one more execution, which does not stream.
+func (s *Server) coalesce(r *http.Request, fn func(ctx context.Context, allowStream bool) tasks.Result) tasks.Result {
+	if r.Method != http.MethodGet {
+		return fn(r.Context(), true)
+	}
+	key := tasks.CacheKey(r)
+	result, shared := s.inflight.Do(r.Context(), key, func(ctx context.Context) tasks.Result {
+		return fn(ctx, true)
+	})
+	if shared && result.Streamed {
+		result, shared = s.inflight.Do(r.Context(), key, func(ctx context.Context) tasks.Result {
+			return fn(ctx, false)
+		})
+		if shared && result.Streamed {
+			// A new request streamed the execution the waiting requests joined
+			return fn(r.Context(), false)
+		}
+	}
+	if shared {
+		taskCoalescedRequestsTotal.WithLabelValues(r.URL.Path).Inc()
+	}
+	return result
+}
+
+// handleCached returns the cached output of the request, running the task if the cache holds
+// no current output for it. Only successful outputs are cached. The output carries its age.
+func (s *Server) handleCached(r *http.Request, handler tasks.TaskHandler, policy tasks.CachePolicy, appConfig config.Config) ([]byte, int, error) {
+	key := tasks.CacheKey(r)
+	content, age, ok := s.cache.Get(policy.Partition, key)
+	if ok {
+		taskCacheRequestsTotal.WithLabelValues("hit").Inc()
+	} else {
+		taskCacheRequestsTotal.WithLabelValues("miss").Inc()
+		result := s.coalesce(r, func(ctx context.Context, _ bool) tasks.Result {
+			content, statusCode, err := handler.Handle(ctx, r, appConfig)
+			return tasks.Result{Content: content, StatusCode: statusCode, Err: err}
+		})
+		if result.Err != nil || result.StatusCode != http.StatusOK {
+			return result.Content, result.StatusCode, result.Err
+		}
+		content = result.Content
+		s.cache.Put(policy, key, content)
+	}
+
+	content, err := tasks.WithCacheAge(content, appConfig, age)
+	if err != nil {
+		return nil, dberrors.HTTPStatus(err), err
+	}
+	return content, http.StatusOK, nil
+}
+
+// writeTaskResponse writes the output of a task handler. Errors are written as problem details
+// to clients that accept JSON, and as metrics or plain text otherwise. Error messages are
+// redacted, since they may quote a DSN.
+func writeTaskResponse(w http.ResponseWriter, r *http.Request, metricContent []byte, statusCode int, err error) {
 	if err != nil {
-		slog.Error("Task handler error", "path", r.URL.Path, "method", r.Method, "status_code", statusCode, "error", err.Error())
-		// If metricContent is available (e.g., a status metric from the handler), write it with the error status.
-		if len(metricContent) > 0 {
+		err = redact.Error(err)
+		slog.Error("Task handler error", "path", r.URL.Path, "method", r.Method, "status_code", statusCode, "request_id", w.Header().Get(RequestIDHeader), "error", err.Error())
+		if acceptsJSON(r) {
+			writeProblem(w, r, statusCode, err)
+		} else if len(metricContent) > 0 {
+			// If metricContent is available (e.g., a status metric from the handler), write it with the error status.
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(statusCode) // Handler determined this status code
 			w.Write(metricContent)
@@ -187,6 +312,8 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	// Handle other fixed paths with middleware
 	testMux.Handle("/metrics", MetricsMiddleware(http.HandlerFunc(s.handleAppMetrics)))
 	testMux.Handle("/health", MetricsMiddleware(http.HandlerFunc(s.handleHealth)))
+	testMux.Handle("/config", MetricsMiddleware(http.HandlerFunc(s.handleConfig)))
+	testMux.Handle("/reload", MetricsMiddleware(http.HandlerFunc(s.handleReloadConfig)))
 	testMux.Handle("/", MetricsMiddleware(http.HandlerFunc(s.handleRoot)))
 
 	// Fallback for paths not explicitly handled by taskHandlers or fixed paths
@@ -201,18 +328,22 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	testMux.ServeHTTP(w, r) // Dispatch the request using the test mux
 }
 
-// Stop gracefully stops the HTTP server
+// Stop gracefully stops the HTTP server and closes the cached database connections
 func (s *Server) Stop(ctx context.Context) error {
+	var shutdownErr error
 	if s.server != nil {
-		return s.server.Shutdown(ctx)
+		shutdownErr = s.server.Shutdown(ctx)
 	}
-	return nil
+	if err := s.dbPool.Close(); err != nil {
+		slog.Error("Failed to close database connections", "error", err)
+	}
+	return shutdownErr
 }
 
-// handleConfig serves the current configuration as JSON
+// handleConfig serves the current configuration as JSON, with the secrets masked
 func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	s.configLock.RLock()
-	cfgJSON, err := json.MarshalIndent(s.Config, "", "  ")
+	cfgJSON, err := json.MarshalIndent(s.Config.Redacted(), "", "  ")
 	s.configLock.RUnlock()
 
 	if err != nil {
@@ -239,12 +370,18 @@ func (s *Server) handleReloadConfig(w http.ResponseWriter, r *http.Request) {
 
 	newCfg, err := config.LoadConfig(s.configFile)
 	if err != nil {
+		err = redact.Error(err)
 		slog.Error("Failed to reload configuration", "file", s.configFile, "error", err)
 		http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	if !reflect.DeepEqual(s.Config.ConnOptions, newCfg.ConnOptions) {
+		// Cached pools compare their options on every use and are rebuilt lazily.
+		slog.Info("Connection options changed, database connection pools will be rebuilt on next use")
+	}
 	s.Config = newCfg
+	s.cache.Clear() // Cached outputs may depend on the old configuration
 	slog.Info("Configuration reloaded successfully", "file", s.configFile)
 	fmt.Fprintln(w, "Configuration reloaded successfully.")
 }
@@ -306,12 +443,22 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 			<tr>
 				<td>query</td>
 				<td>SQL query to execute</td>
-				<td>Yes</td>
+				<td>Yes (unless query_name is used)</td>
+			</tr>
+			<tr>
+				<td>query_name</td>
+				<td>Name of a query from the query catalog in the config</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>source</td>
+				<td>Name of a data source defined in the config (replaces the connection parameters below)</td>
+				<td>No</td>
 			</tr>
 			<tr>
 				<td>type</td>
 				<td>Database type (e.g., pg, sqlite, oracle, sqlserver)</td>
-				<td>Yes</td>
+				<td>Yes (unless source is used)</td>
 			</tr>
 			<tr>
 				<td>username</td>
@@ -340,14 +487,104 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 			</tr>
 			<tr>
 				<td>value_column</td>
-				<td>Column to use as metric value</td>
+				<td>Column to use as metric value (empty or none: info mode)</td>
 				<td>No (default: "value")</td>
 			</tr>
+			<tr>
+				<td>mode</td>
+				<td>How rows become samples (value, info, row_count, wide)</td>
+				<td>No (default: value)</td>
+			</tr>
+			<tr>
+				<td>name_column</td>
+				<td>Column whose value is used as the metric name (long-format results)</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>value_columns</td>
+				<td>Comma-separated columns to expose as separate metrics (column or column:metric_name)</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>label_columns / drop_columns</td>
+				<td>Comma-separated columns to keep as labels, or to drop from the labels</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>rename</td>
+				<td>Label name for a column (column:label), repeatable</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>const_label.&lt;name&gt;</td>
+				<td>Constant label added to every series</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>null_label_value</td>
+				<td>Label value used for NULL columns</td>
+				<td>No (default: empty)</td>
+			</tr>
+			<tr>
+				<td>null_value</td>
+				<td>What NULL values in value columns become (skip, zero, nan)</td>
+				<td>No (default: skip)</td>
+			</tr>
+			<tr>
+				<td>on_duplicate</td>
+				<td>Handling of rows that produce the same series (error, first, last, sum, max, min)</td>
+				<td>No (default: error)</td>
+			</tr>
+			<tr>
+				<td>timestamp_column</td>
+				<td>Column holding the timestamp of each sample (time value, unix seconds or milliseconds)</td>
+				<td>No</td>
+			</tr>
 			<tr>
 				<td>metric_prefix</td>
 				<td>Prefix for metric names from SQL query</td>
 				<td>No (default: "sql_query_result" from config)</td>
 			</tr>
+			<tr>
+				<td>metric_type</td>
+				<td>Type of the generated metrics (counter, gauge, histogram, summary, untyped)</td>
+				<td>No (default: gauge)</td>
+			</tr>
+			<tr>
+				<td>metric_help</td>
+				<td>HELP text of the generated metrics</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>buckets / bucket_column / sum_column</td>
+				<td>Histogram buckets for raw values, or the bucket bound (le) and sum columns of pre-aggregated buckets</td>
+				<td>For metric_type=histogram</td>
+			</tr>
+			<tr>
+				<td>quantiles</td>
+				<td>Comma-separated quantiles computed from raw values</td>
+				<td>For metric_type=summary</td>
+			</tr>
+			<tr>
+				<td>arg / arg.&lt;name&gt;</td>
+				<td>Positional or named (:name) bind argument for the query</td>
+				<td>No</td>
+			</tr>
+			<tr>
+				<td>arg_type.&lt;position or name&gt;</td>
+				<td>Type of a bind argument (string, int, float, time)</td>
+				<td>No (default: string)</td>
+			</tr>
+			<tr>
+				<td>cache_ttl</td>
+				<td>Reuse the output of identical requests for this long (e.g. 30s)</td>
+				<td>No (default: no caching)</td>
+			</tr>
+			<tr>
+				<td>stream</td>
+				<td>Write the metrics while the rows are read, followed by the status metrics</td>
+				<td>No (default: false)</td>
+			</tr>
 		</table>
 		<h3>Example for /sql</h3>
 		<code>/sql?type=pg&username=user&password=pass&host=localhost&db=postgres&query=SELECT+name,+value+FROM+metrics&value_column=value</code>
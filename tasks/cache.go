@@ -0,0 +1,152 @@
+package tasks
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"job_runner/config"
+	"job_runner/metric"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CacheableTaskHandler is a TaskHandler whose output can be reused by identical requests for a
+// while. Caching is opt-in: the output of handlers that do not implement it is never cached.
+type CacheableTaskHandler interface {
+	TaskHandler
+	// CachePolicy returns how the output of the request is cached. A policy with a zero TTL
+	// disables caching for the request; an error rejects the request.
+	CachePolicy(r *http.Request, appConfig config.Config) (CachePolicy, error)
+}
+
+// CachePolicy describes how the output of a request is cached.
+type CachePolicy struct {
+	TTL        time.Duration // How long the output is reused; zero disables caching
+	Partition  string        // Partition the output is cached in, such as the data source
+	MaxEntries int           // Outputs the partition holds at most; zero means no limit
+}
+
+// CacheAgeMetricName is the metric added to the output of a cached task. It holds the
+// number of seconds since the output was produced.
+const CacheAgeMetricName = "task_cache_age_seconds"
+
+const cacheAgeHelp = "Seconds since the task output was produced; 0 unless it was served from the cache."
+
+// Cache holds task outputs for reuse by identical requests. Every partition evicts its least
+// recently used outputs beyond its size limit. A Cache is safe for concurrent use.
+type Cache struct {
+	mu         sync.Mutex
+	partitions map[string]*cachePartition
+}
+
+// cachePartition holds the outputs of one partition, most recently used first.
+type cachePartition struct {
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cacheEntry is a cached task output.
+type cacheEntry struct {
+	key     string
+	content []byte
+	created time.Time
+	expires time.Time
+}
+
+// NewCache creates an empty Cache.
+func NewCache() *Cache {
+	return &Cache{partitions: make(map[string]*cachePartition)}
+}
+
+// CacheKey returns the key of a request: its path and parameters, sorted by name. The key is
+// hashed, so that credentials passed as parameters are not kept in memory.
+func CacheKey(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.Query().Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the output cached under key in the partition and its age, unless it has expired.
+func (c *Cache) Get(partition, key string) ([]byte, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.partitions[partition]
+	if !ok {
+		return nil, 0, false
+	}
+	elem, ok := p.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		p.remove(elem)
+		return nil, 0, false
+	}
+	p.lru.MoveToFront(elem)
+	return entry.content, now.Sub(entry.created), true
+}
+
+// Put caches content under key for the TTL of the policy, evicting the least recently used
+// outputs of its partition beyond the size limit of the policy.
+func (c *Cache) Put(policy CachePolicy, key string, content []byte) {
+	if policy.TTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.partitions[policy.Partition]
+	if !ok {
+		p = &cachePartition{entries: make(map[string]*list.Element), lru: list.New()}
+		c.partitions[policy.Partition] = p
+	}
+	if elem, ok := p.entries[key]; ok {
+		p.remove(elem)
+	}
+	now := time.Now()
+	p.entries[key] = p.lru.PushFront(&cacheEntry{key: key, content: content, created: now, expires: now.Add(policy.TTL)})
+	for policy.MaxEntries > 0 && p.lru.Len() > policy.MaxEntries {
+		p.remove(p.lru.Back())
+	}
+}
+
+// Len returns the number of outputs cached in the partition, including expired ones not yet removed.
+func (c *Cache) Len(partition string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.partitions[partition]; ok {
+		return p.lru.Len()
+	}
+	return 0
+}
+
+// Clear removes all cached outputs.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partitions = make(map[string]*cachePartition)
+}
+
+// remove removes an entry from the partition.
+func (p *cachePartition) remove(elem *list.Element) {
+	p.lru.Remove(elem)
+	delete(p.entries, elem.Value.(*cacheEntry).key)
+}
+
+// WithCacheAge returns content followed by the cache age metric.
+func WithCacheAge(content []byte, appConfig config.Config, age time.Duration) ([]byte, error) {
+	set, err := NewMetricSet(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	set.Describe(CacheAgeMetricName, metric.TypeGauge, cacheAgeHelp)
+	set.Add(CacheAgeMetricName, nil, age.Seconds())
+
+	var buf bytes.Buffer
+	buf.Grow(len(content) + 128)
+	buf.Write(content)
+	set.WritePrometheus(&buf)
+	return buf.Bytes(), nil
+}
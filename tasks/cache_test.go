@@ -0,0 +1,90 @@
+package tasks_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"job_runner/config"
+	"job_runner/tasks"
+)
+
+func TestCache(t *testing.T) {
+	cache := tasks.NewCache()
+	policy := tasks.CachePolicy{TTL: time.Minute, Partition: "prod", MaxEntries: 2}
+
+	cache.Put(policy, "a", []byte("output a"))
+	content, age, ok := cache.Get("prod", "a")
+	if !ok || string(content) != "output a" {
+		t.Fatalf("Get(a) = %q, %v, want cached output", content, ok)
+	}
+	if age < 0 || age > time.Second {
+		t.Errorf("Get(a) age = %v, want close to 0", age)
+	}
+	if _, _, ok := cache.Get("other", "a"); ok {
+		t.Errorf("Get(a) found output in another partition")
+	}
+
+	// The least recently used output is evicted beyond the size limit
+	cache.Put(policy, "b", []byte("output b"))
+	cache.Get("prod", "a")
+	cache.Put(policy, "c", []byte("output c"))
+	if _, _, ok := cache.Get("prod", "b"); ok {
+		t.Errorf("Get(b) found output that should have been evicted")
+	}
+	if _, _, ok := cache.Get("prod", "a"); !ok {
+		t.Errorf("Get(a) did not find recently used output")
+	}
+	if got := cache.Len("prod"); got != 2 {
+		t.Errorf("Len(prod) = %d, want 2", got)
+	}
+
+	cache.Put(tasks.CachePolicy{TTL: 20 * time.Millisecond, Partition: "prod"}, "short", []byte("output"))
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := cache.Get("prod", "short"); ok {
+		t.Errorf("Get(short) found expired output")
+	}
+
+	cache.Put(tasks.CachePolicy{}, "uncached", []byte("output"))
+	if _, _, ok := cache.Get("", "uncached"); ok {
+		t.Errorf("Get(uncached) found output stored without TTL")
+	}
+
+	cache.Clear()
+	if _, _, ok := cache.Get("prod", "a"); ok {
+		t.Errorf("Get(a) found output after Clear")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	key := func(target string) string {
+		return tasks.CacheKey(httptest.NewRequest("GET", target, nil))
+	}
+	if key("/sql?source=prod&query_name=orders") != key("/sql?query_name=orders&source=prod") {
+		t.Errorf("Keys differ for the same parameters in another order")
+	}
+	if key("/sql?source=prod&query_name=orders") == key("/sql?source=prod&query_name=users") {
+		t.Errorf("Keys are equal for different parameters")
+	}
+	if key("/sql?source=prod") == key("/http_check?source=prod") {
+		t.Errorf("Keys are equal for different paths")
+	}
+	if k := key("/sql?password=secret"); strings.Contains(k, "secret") {
+		t.Errorf("Key %q contains a parameter value", k)
+	}
+}
+
+func TestWithCacheAge(t *testing.T) {
+	content, err := tasks.WithCacheAge([]byte("status 1\n"), config.DefaultConfig(), 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WithCacheAge failed: %v", err)
+	}
+	expected := "status 1\n" +
+		"# HELP task_cache_age_seconds Seconds since the task output was produced; 0 unless it was served from the cache.\n" +
+		"# TYPE task_cache_age_seconds gauge\n" +
+		"task_cache_age_seconds 1.5\n"
+	if string(content) != expected {
+		t.Errorf("Output = %q, want %q", content, expected)
+	}
+}
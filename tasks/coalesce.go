@@ -0,0 +1,112 @@
+package tasks
+
+import (
+	"context"
+	dberrors "job_runner/errors"
+	"sync"
+)
+
+// Result is the outcome of a task execution.
+type Result struct {
+	Content    []byte
+	StatusCode int
+	Err        error
+	Streamed   bool // The output was written to the response of the request that ran the task
+}
+
+// errExecutionFailed is the error shared with waiting requests when an execution panics.
+var errExecutionFailed = dberrors.New(dberrors.CodeInternal, "task execution did not complete")
+
+// Coalescer runs identical concurrent task executions once: requests made while an execution
+// with the same key is in flight wait for it and share its result. The execution is canceled
+// only once every request sharing it is gone. A Coalescer is safe for concurrent use.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an execution in flight.
+type coalescedCall struct {
+	key     string
+	done    chan struct{}
+	result  Result
+	waiters int                // Requests still interested in the result
+	cancel  context.CancelFunc // Cancels the execution
+}
+
+// NewCoalescer creates a Coalescer with no execution in flight.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// Do runs fn and returns its result, unless an execution with the same key is in flight: then
+// it waits for that execution and returns its result with shared set to true. The context fn
+// receives is not canceled with ctx while other requests wait for the result. A waiting
+// request whose ctx is done stops waiting and gets the error of ctx. The content of a result
+// is shared and must not be modified.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(ctx context.Context) Result) (result Result, shared bool) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.result, true
+		case <-ctx.Done():
+			c.leave(call)
+			err := dberrors.Wrap(dberrors.CodeCanceled, ctx.Err(), "request canceled while waiting for an identical request")
+			return Result{StatusCode: err.Code.HTTPStatus(), Err: err}, true
+		}
+	}
+
+	execCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	call := &coalescedCall{
+		key:     key,
+		done:    make(chan struct{}),
+		result:  Result{StatusCode: errExecutionFailed.Code.HTTPStatus(), Err: errExecutionFailed},
+		waiters: 1,
+		cancel:  cancel,
+	}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { c.leave(call) })
+	defer func() {
+		stop()
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+		close(call.done)
+		cancel()
+	}()
+	call.result = fn(execCtx)
+	return call.result, false
+}
+
+// Waiting returns the number of requests sharing the execution in flight under key, including
+// the one that runs it, or 0 if there is none.
+func (c *Coalescer) Waiting(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call.waiters
+	}
+	return 0
+}
+
+// leave records that a request is no longer interested in the result of the call, canceling
+// the execution if it was the last one. Later requests then start a new execution.
+func (c *Coalescer) leave(call *coalescedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	if c.calls[call.key] == call {
+		delete(c.calls, call.key)
+	}
+	call.cancel()
+}
@@ -0,0 +1,123 @@
+package tasks_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"job_runner/tasks"
+)
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	c := tasks.NewCoalescer()
+	var executions atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) tasks.Result {
+		executions.Add(1)
+		<-release
+		return tasks.Result{Content: []byte("output"), StatusCode: http.StatusOK}
+	}
+
+	const requests = 5
+	results := make([]tasks.Result, requests)
+	shared := make([]bool, requests)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], shared[i] = c.Do(context.Background(), "key", fn)
+		}()
+	}
+	waitFor(t, "all requests to wait", func() bool { return c.Waiting("key") == requests })
+	close(release)
+	wg.Wait()
+
+	if got := executions.Load(); got != 1 {
+		t.Errorf("Executions = %d, want 1", got)
+	}
+	sharedCount := 0
+	for i, result := range results {
+		if string(result.Content) != "output" || result.StatusCode != http.StatusOK || result.Err != nil {
+			t.Errorf("Request %d got %+v, want the shared output", i, result)
+		}
+		if shared[i] {
+			sharedCount++
+		}
+	}
+	if sharedCount != requests-1 {
+		t.Errorf("%d requests shared the result, want %d", sharedCount, requests-1)
+	}
+	if got := c.Waiting("key"); got != 0 {
+		t.Errorf("Waiting(key) = %d after completion, want 0", got)
+	}
+
+	// Different keys run separately, and a completed execution is not reused
+	c.Do(context.Background(), "other", func(context.Context) tasks.Result { executions.Add(1); return tasks.Result{} })
+	c.Do(context.Background(), "key", func(context.Context) tasks.Result { executions.Add(1); return tasks.Result{} })
+	if got := executions.Load(); got != 3 {
+		t.Errorf("Executions = %d, want 3", got)
+	}
+}
+
+func TestCoalescerCancellation(t *testing.T) {
+	c := tasks.NewCoalescer()
+	execCtx := make(chan context.Context, 1)
+	fn := func(ctx context.Context) tasks.Result {
+		execCtx <- ctx
+		<-ctx.Done()
+		return tasks.Result{StatusCode: http.StatusGatewayTimeout, Err: ctx.Err()}
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan tasks.Result, 1)
+	go func() {
+		result, _ := c.Do(leaderCtx, "key", fn)
+		leaderDone <- result
+	}()
+	ctx := <-execCtx
+
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	followerDone := make(chan tasks.Result, 1)
+	go func() {
+		result, _ := c.Do(followerCtx, "key", fn)
+		followerDone <- result
+	}()
+	waitFor(t, "the follower to wait", func() bool { return c.Waiting("key") == 2 })
+
+	// The execution goes on while a request still waits for it
+	cancelLeader()
+	waitFor(t, "the leader to leave", func() bool { return c.Waiting("key") == 1 })
+	if ctx.Err() != nil {
+		t.Fatalf("Execution canceled while a request waits for it")
+	}
+
+	cancelFollower()
+	result := <-followerDone
+	if !errors.Is(result.Err, context.Canceled) || result.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Follower got %+v, want a cancellation error", result)
+	}
+	<-leaderDone
+	if ctx.Err() == nil {
+		t.Errorf("Execution not canceled once every request left")
+	}
+	if got := c.Waiting("key"); got != 0 {
+		t.Errorf("Waiting(key) = %d after cancellation, want 0", got)
+	}
+}
@@ -1,17 +1,18 @@
 package httpcheck
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"job_runner/config"
+	dberrors "job_runner/errors"
+	"job_runner/metric"
+	"job_runner/redact"
+	"job_runner/tasks"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/VictoriaMetrics/metrics"
 )
 
 const (
@@ -32,13 +33,13 @@ func NewHTTPCheckTaskHandler() *HTTPCheckTaskHandler {
 // Handle processes the HTTP request, performs the HTTP check, and returns Prometheus metrics.
 func (h *HTTPCheckTaskHandler) Handle(ctx context.Context, r *http.Request, appConfig config.Config) ([]byte, int, error) {
 	if r.Method != http.MethodGet {
-		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed for http_check endpoint, use GET")
+		return failed(nil, dberrors.New(dberrors.CodeMethodNotAllowed, "method not allowed for http_check endpoint, use GET"))
 	}
 
 	queryParams := r.URL.Query()
 	targetURL := queryParams.Get("target_url")
 	if targetURL == "" {
-		return nil, http.StatusBadRequest, fmt.Errorf("missing required parameter: target_url")
+		return failed(nil, dberrors.New(dberrors.CodeInvalidRequest, "missing required parameter: target_url"))
 	}
 
 	method := strings.ToUpper(queryParams.Get("method"))
@@ -52,7 +53,7 @@ func (h *HTTPCheckTaskHandler) Handle(ctx context.Context, r *http.Request, appC
 	if expectedStatusStr != "" {
 		expectedStatus, parseErr = strconv.Atoi(expectedStatusStr)
 		if parseErr != nil {
-			return nil, http.StatusBadRequest, fmt.Errorf("invalid expected_status: %w", parseErr)
+			return failed(nil, dberrors.Wrap(dberrors.CodeInvalidRequest, parseErr, "invalid expected_status"))
 		}
 	}
 
@@ -64,14 +65,16 @@ func (h *HTTPCheckTaskHandler) Handle(ctx context.Context, r *http.Request, appC
 	if timeoutStr != "" {
 		d, err := time.ParseDuration(timeoutStr)
 		if err != nil {
-			return nil, http.StatusBadRequest, fmt.Errorf("invalid timeout duration: %w", err)
+			return failed(nil, dberrors.Wrap(dberrors.CodeInvalidRequest, err, "invalid timeout duration"))
 		}
 		taskTimeout = d
 	}
 
-	// Prepare metric set and buffer
-	requestScopedMetricSet := metrics.NewSet()
-	var metricBuf bytes.Buffer
+	// Prepare the task output
+	output, err := tasks.NewOutput(appConfig, appConfig.Limits)
+	if err != nil {
+		return failed(nil, err)
+	}
 
 	// Create a context with the specified timeout for the HTTP request
 	checkCtx, cancel := context.WithTimeout(ctx, taskTimeout)
@@ -79,8 +82,8 @@ func (h *HTTPCheckTaskHandler) Handle(ctx context.Context, r *http.Request, appC
 
 	req, err := http.NewRequestWithContext(checkCtx, method, targetURL, nil)
 	if err != nil {
-		writeMetricsToBuf(requestScopedMetricSet, &metricBuf, targetURL, method, 0, 0, 0, err)
-		return metricBuf.Bytes(), http.StatusInternalServerError, fmt.Errorf("failed to create request for target_url %s: %w", targetURL, err)
+		addMetrics(output.Results, targetURL, method, 0, 0, 0, err)
+		return failed(output.Bytes(), dberrors.Wrap(dberrors.CodeInvalidRequest, redact.Error(err), fmt.Sprintf("failed to create request for target_url %s", redact.String(targetURL))))
 	}
 
 	client := &http.Client{}
@@ -92,12 +95,9 @@ func (h *HTTPCheckTaskHandler) Handle(ctx context.Context, r *http.Request, appC
 
 	if err != nil {
 		// Handle client.Do errors (e.g., connection refused, DNS lookup failed, context deadline exceeded)
-		writeMetricsToBuf(requestScopedMetricSet, &metricBuf, targetURL, method, 0, duration, 0, err)
-		// Determine appropriate status code based on error (e.g., context deadline -> Gateway Timeout)
-		if strings.Contains(err.Error(), "context deadline exceeded") {
-			return metricBuf.Bytes(), http.StatusGatewayTimeout, fmt.Errorf("request to target_url %s timed out: %w", targetURL, err)
-		}
-		return metricBuf.Bytes(), http.StatusServiceUnavailable, fmt.Errorf("request to target_url %s failed: %w", targetURL, err)
+		addMetrics(output.Results, targetURL, method, 0, duration, 0, err)
+		// A deadline in the cause makes this a timeout error (Gateway Timeout)
+		return failed(output.Bytes(), dberrors.Wrap(dberrors.CodeUnavailable, err, fmt.Sprintf("request to target_url %s failed", redact.String(targetURL))))
 	}
 	defer resp.Body.Close()
 
@@ -112,23 +112,38 @@ func (h *HTTPCheckTaskHandler) Handle(ctx context.Context, r *http.Request, appC
 		success = 1
 	}
 
-	writeMetricsToBuf(requestScopedMetricSet, &metricBuf, targetURL, method, success, duration, actualStatus, nil)
-	return metricBuf.Bytes(), http.StatusOK, nil
+	addMetrics(output.Results, targetURL, method, success, duration, actualStatus, nil)
+	if err := output.Check(); err != nil {
+		return failed(output.Bytes(), err)
+	}
+	return output.Bytes(), http.StatusOK, nil
+}
+
+// failed returns the outcome of a check that failed with err: content, if any, is written with
+// the HTTP status of the error code.
+func failed(content []byte, err error) ([]byte, int, error) {
+	return content, dberrors.HTTPStatus(err), err
 }
 
-func writeMetricsToBuf(set *metrics.Set, buf *bytes.Buffer, targetURL, method string, success float64, duration time.Duration, actualStatus int, reqErr error) {
-	labels := fmt.Sprintf(`{target_url=%q, method=%q}`, targetURL, method)
+// addMetrics adds the metrics describing the result of a check to the set. A failed check is
+// labeled with the class of its error, or http_status for an unexpected status code.
+func addMetrics(set *metric.Set, targetURL, method string, success float64, duration time.Duration, actualStatus int, reqErr error) {
+	labels := []metric.Label{{Name: "target_url", Value: redact.String(targetURL)}, {Name: "method", Value: method}}
 	if actualStatus > 0 {
-		labels = fmt.Sprintf(`{target_url=%q, method=%q, status_code="%d"}`, targetURL, method, actualStatus)
+		labels = append(labels, metric.Label{Name: "status_code", Value: strconv.Itoa(actualStatus)})
 	}
 	if reqErr != nil {
-		labels = fmt.Sprintf(`{target_url=%q, method=%q, error=%q}`, targetURL, method, reqErr.Error())
+		labels = append(labels, metric.Label{Name: "error_type", Value: dberrors.Classify(reqErr)})
+	} else if success == 0 {
+		labels = append(labels, metric.Label{Name: "error_type", Value: dberrors.ClassHTTPStatus})
 	}
 
-	set.GetOrCreateGauge(MetricPrefix+"_up"+labels, nil).Set(success)
-	set.GetOrCreateGauge(MetricPrefix+"_duration_seconds"+labels, nil).Set(duration.Seconds())
+	set.Describe(MetricPrefix+"_up", metric.TypeGauge, "Whether the target responded with the expected status code (1) or not (0).")
+	set.Add(MetricPrefix+"_up", labels, success)
+	set.Describe(MetricPrefix+"_duration_seconds", metric.TypeGauge, "Duration of the HTTP request in seconds.")
+	set.Add(MetricPrefix+"_duration_seconds", labels, duration.Seconds())
 	if actualStatus > 0 {
-		set.GetOrCreateGauge(MetricPrefix+"_status_code"+labels, nil).Set(float64(actualStatus))
+		set.Describe(MetricPrefix+"_status_code", metric.TypeGauge, "HTTP status code returned by the target.")
+		set.Add(MetricPrefix+"_status_code", labels, float64(actualStatus))
 	}
-	set.WritePrometheus(buf)
 }
@@ -0,0 +1,179 @@
+package tasks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"job_runner/config"
+	dberrors "job_runner/errors"
+	"job_runner/metric"
+)
+
+// NewMetricSet creates the set a task writes its metrics to, with the constant labels
+// and the metric name scheme from the config applied.
+func NewMetricSet(appConfig config.Config) (*metric.Set, error) {
+	set := metric.NewSet()
+	if err := applyNaming(set, appConfig); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// namer is implemented by metric.Set and metric.Encoder.
+type namer interface {
+	SetConstLabels(labels []metric.Label)
+	SetNameScheme(scheme metric.NameScheme)
+}
+
+// applyNaming applies the constant labels and the metric name scheme from the config.
+func applyNaming(n namer, appConfig config.Config) error {
+	constLabels, err := metric.LabelsFromMap(appConfig.ConstLabels)
+	if err != nil {
+		return dberrors.Wrap(dberrors.CodeConfig, err, "invalid const_labels in config")
+	}
+	n.SetConstLabels(constLabels)
+	if appConfig.UTF8Names {
+		n.SetNameScheme(metric.UTF8Names)
+	}
+	return nil
+}
+
+// TruncatedMetricName is the metric added to the output of a task whose results were truncated.
+// Its limit label names the limit that was exceeded.
+const TruncatedMetricName = "task_output_truncated"
+
+const truncatedHelp = "Whether the task output was truncated because it exceeded a limit (1)."
+
+// Output is the output of a task: result metrics, which are subject to the output limits,
+// followed by status metrics, which are always written in full.
+type Output struct {
+	Results *metric.Set
+	Status  *metric.Set
+
+	limits   config.Limits
+	rendered *bytes.Buffer // Results in the exposition format, once rendered
+	failed   bool          // The results exceeded a limit under the fail policy
+}
+
+// NewOutput creates the output of a task with the given limits. The row limit is not
+// applied here; SQL tasks pass it to their generator.
+func NewOutput(appConfig config.Config, limits config.Limits) (*Output, error) {
+	results, err := NewMetricSet(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	status, err := NewMetricSet(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	results.SetLimits(limits.MaxSeries, limits.MaxResponseBytes)
+	return &Output{Results: results, Status: status, limits: limits}, nil
+}
+
+// LimitError is returned by Output.Check when the results exceed a limit under the fail policy.
+type LimitError struct {
+	Limit string // Name of the limit, e.g. max_series
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("task output exceeds the %s limit of %d", e.Limit, e.Max)
+}
+
+// ErrorCode returns the code of limit errors.
+func (e *LimitError) ErrorCode() dberrors.Code {
+	return dberrors.CodeLimitExceeded
+}
+
+// Check renders the results and, under the fail policy, returns a *LimitError if they were
+// truncated. The results are then left out of Bytes. Under the truncate policy it returns nil.
+func (o *Output) Check() error {
+	o.render()
+	limit := o.Results.Truncated()
+	if limit == "" || o.limits.OnLimit != config.OnLimitFail {
+		return nil
+	}
+	o.failed = true
+	return &LimitError{Limit: limit, Max: o.limitValue(limit)}
+}
+
+// Bytes returns the results, followed by the truncated indicator if they were truncated
+// and by the status metrics.
+func (o *Output) Bytes() []byte {
+	o.render()
+	var buf bytes.Buffer
+	if !o.failed {
+		buf.Write(o.rendered.Bytes())
+		recordTruncated(o.Status, o.Results.Truncated())
+	}
+	o.Status.WritePrometheus(&buf)
+	return buf.Bytes()
+}
+
+// recordTruncated adds the truncated indicator to status if a limit was exceeded.
+func recordTruncated(status *metric.Set, limit string) {
+	if limit != "" {
+		status.Describe(TruncatedMetricName, metric.TypeGauge, truncatedHelp)
+		status.Add(TruncatedMetricName, []metric.Label{{Name: "limit", Value: limit}}, 1)
+	}
+}
+
+// render writes the results once; the byte limit is applied while writing.
+func (o *Output) render() {
+	if o.rendered == nil {
+		o.rendered = new(bytes.Buffer)
+		o.Results.WritePrometheus(o.rendered)
+	}
+}
+
+// limitValue returns the configured value of the named limit.
+func (o *Output) limitValue(limit string) int {
+	switch limit {
+	case metric.LimitMaxSeries:
+		return o.limits.MaxSeries
+	case metric.LimitMaxRows:
+		return o.limits.MaxRows
+	case metric.LimitMaxResponseBytes:
+		return o.limits.MaxResponseBytes
+	}
+	return 0
+}
+
+// StreamOutput is the output of a task that streams its results: result samples are written
+// as they are produced, subject to the output limits, and the status metrics follow them once
+// the task is done. Limits always truncate a stream: the fail policy cannot be applied once the
+// response has started, so tasks buffer their output under it.
+type StreamOutput struct {
+	Results *metric.Encoder
+	Status  *metric.Set
+
+	w io.Writer
+}
+
+// NewStreamOutput creates the output of a task that streams its results to w. The row limit
+// is not applied here; SQL tasks pass it to their generator.
+func NewStreamOutput(w io.Writer, appConfig config.Config, limits config.Limits) (*StreamOutput, error) {
+	results := metric.NewEncoder(w)
+	if err := applyNaming(results, appConfig); err != nil {
+		return nil, err
+	}
+	status, err := NewMetricSet(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	results.SetLimits(limits.MaxSeries, limits.MaxResponseBytes)
+	return &StreamOutput{Results: results, Status: status, w: w}, nil
+}
+
+// Finish writes the remaining results, followed by the truncated indicator if they were
+// truncated and by the status metrics. It returns the first error writing to w.
+func (o *StreamOutput) Finish() error {
+	if err := o.Results.Flush(); err != nil {
+		return err
+	}
+	recordTruncated(o.Status, o.Results.Truncated())
+	var buf bytes.Buffer
+	o.Status.WritePrometheus(&buf)
+	_, err := o.w.Write(buf.Bytes())
+	return err
+}
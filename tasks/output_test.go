@@ -0,0 +1,112 @@
+package tasks_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"job_runner/config"
+	"job_runner/metric"
+	"job_runner/tasks"
+)
+
+func TestOutputLimits(t *testing.T) {
+	testCases := []struct {
+		name       string
+		limits     config.Limits
+		wantErr    string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:     "no limits",
+			expected: []string{`item{n="a"} 1`, `item{n="c"} 3`, `status 1`},
+		},
+		{
+			name:       "max series truncates",
+			limits:     config.Limits{MaxSeries: 2},
+			expected:   []string{`item{n="a"} 1`, `item{n="b"} 2`, `task_output_truncated{limit="max_series"} 1`, `status 1`},
+			unexpected: []string{`item{n="c"}`},
+		},
+		{
+			name:       "max response bytes truncates",
+			limits:     config.Limits{MaxResponseBytes: 40},
+			expected:   []string{"# TYPE item gauge\n" + `item{n="a"} 1` + "\n", `task_output_truncated{limit="max_response_bytes"} 1`, `status 1`},
+			unexpected: []string{`item{n="b"}`},
+		},
+		{
+			name:       "max series fails",
+			limits:     config.Limits{MaxSeries: 2, OnLimit: config.OnLimitFail},
+			wantErr:    "task output exceeds the max_series limit of 2",
+			expected:   []string{`status 1`},
+			unexpected: []string{"item", "task_output_truncated"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := tasks.NewOutput(config.DefaultConfig(), tc.limits)
+			if err != nil {
+				t.Fatalf("NewOutput failed: %v", err)
+			}
+			for i, n := range []string{"a", "b", "c"} {
+				output.Results.Add("item", []metric.Label{{Name: "n", Value: n}}, float64(i+1))
+			}
+			output.Status.Add("status", nil, 1)
+
+			err = output.Check()
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.wantErr != "" {
+				var limitErr *tasks.LimitError
+				if !errors.As(err, &limitErr) || err.Error() != tc.wantErr {
+					t.Fatalf("Expected LimitError %q, got %v", tc.wantErr, err)
+				}
+			}
+
+			content := string(output.Bytes())
+			results, _, _ := strings.Cut(content, "# TYPE status") // Status metrics follow the results
+			if tc.limits.MaxResponseBytes > 0 && len(results) > tc.limits.MaxResponseBytes {
+				t.Errorf("Results exceed %d bytes. Output:\n%s", tc.limits.MaxResponseBytes, content)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(content, expected) {
+					t.Errorf("Expected %q not found in output. Output:\n%s", expected, content)
+				}
+			}
+			for _, unexpected := range tc.unexpected {
+				if strings.Contains(content, unexpected) {
+					t.Errorf("Unexpected %q found in output. Output:\n%s", unexpected, content)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamOutput(t *testing.T) {
+	var buf bytes.Buffer
+	output, err := tasks.NewStreamOutput(&buf, config.DefaultConfig(), config.Limits{MaxSeries: 2})
+	if err != nil {
+		t.Fatalf("NewStreamOutput failed: %v", err)
+	}
+	for i, n := range []string{"a", "b", "c"} {
+		output.Results.Add("item", []metric.Label{{Name: "n", Value: n}}, float64(i+1))
+	}
+	output.Status.Add("status", nil, 1)
+	if err := output.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	expected := "# TYPE item gauge\n" +
+		`item{n="a"} 1` + "\n" +
+		`item{n="b"} 2` + "\n" +
+		"# TYPE status gauge\nstatus 1\n" +
+		"# HELP task_output_truncated Whether the task output was truncated because it exceeded a limit (1).\n" +
+		"# TYPE task_output_truncated gauge\n" +
+		`task_output_truncated{limit="max_series"} 1` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Output = %q, want %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,79 @@
+package sql
+
+import (
+	stdsql "database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"job_runner/db"
+)
+
+const (
+	argParam           = "arg"
+	namedArgPrefix     = "arg."
+	argTypeParamPrefix = "arg_type."
+)
+
+// queryArgs builds the bind arguments for the query from the request parameters.
+// Repeated "arg" parameters are positional arguments; "arg.<name>" parameters are
+// named arguments referenced as :name in the query. The type of an argument is taken
+// from "arg_type.<position or name>" or, failing that, from declaredTypes (the catalog's
+// arg_types); arguments without a type are bound as strings.
+func queryArgs(queryParams url.Values, declaredTypes map[string]string) ([]any, error) {
+	argType := func(key string) string {
+		if t := queryParams.Get(argTypeParamPrefix + key); t != "" {
+			return t
+		}
+		return declaredTypes[key]
+	}
+
+	var args []any
+	for i, raw := range queryParams[argParam] {
+		key := strconv.Itoa(i + 1)
+		value, err := db.ConvertArg(raw, argType(key))
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", key, err)
+		}
+		args = append(args, value)
+	}
+
+	// Named arguments are sorted so the argument list does not depend on map order.
+	var names []string
+	for param := range queryParams {
+		if name, ok := strings.CutPrefix(param, namedArgPrefix); ok {
+			if !isArgName(name) {
+				return nil, fmt.Errorf("invalid argument name %q", name)
+			}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := db.ConvertArg(queryParams.Get(namedArgPrefix+name), argType(name))
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", name, err)
+		}
+		args = append(args, stdsql.Named(name, value))
+	}
+
+	return args, nil
+}
+
+// isArgName reports whether name can be used as a named argument (a plain SQL identifier).
+func isArgName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case i > 0 && c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
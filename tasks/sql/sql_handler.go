@@ -1,106 +1,494 @@
 package sql
 
 import (
-	"bytes"
 	"context"
+	stdsql "database/sql"
 	"fmt"
 	"job_runner/config"
 	"job_runner/db"
+	dberrors "job_runner/errors"
 	"job_runner/metric"
+	"job_runner/tasks"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/VictoriaMetrics/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// duplicateSeriesTotal counts result rows that produced a series another row already produced.
+var duplicateSeriesTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sql_duplicate_series_total",
+		Help: "Total number of SQL result rows that duplicated an existing series.",
+	},
+	[]string{"on_duplicate"},
 )
 
 // SQLTaskHandler handles SQL query tasks.
-// It expects query parameters like "query", "type", "host", "db", etc.
-type SQLTaskHandler struct{}
+// It expects query parameters like "query" plus either "source" (a data source
+// defined in the config) or the raw connection parameters "type", "host", "db", etc.
+// Database connections are taken from the shared pool and stay open between requests.
+type SQLTaskHandler struct {
+	pool *db.Pool
+}
 
-// NewSQLTaskHandler creates a new SQLTaskHandler.
-func NewSQLTaskHandler() *SQLTaskHandler {
-	return &SQLTaskHandler{}
+// NewSQLTaskHandler creates a new SQLTaskHandler that uses the given connection pool.
+func NewSQLTaskHandler(pool *db.Pool) *SQLTaskHandler {
+	return &SQLTaskHandler{pool: pool}
 }
 
 // Handle processes the HTTP request, executes the SQL query, and returns Prometheus metrics.
 func (h *SQLTaskHandler) Handle(ctx context.Context, r *http.Request, appConfig config.Config) ([]byte, int, error) {
+	_, content, status, err := h.handle(ctx, nil, r, appConfig)
+	return content, status, err
+}
+
+// HandleStream is like Handle, but streams the metrics to w as the rows are read if the
+// request asks for it with the "stream" parameter and its settings allow it.
+func (h *SQLTaskHandler) HandleStream(ctx context.Context, w http.ResponseWriter, r *http.Request, appConfig config.Config) (bool, []byte, int, error) {
+	return h.handle(ctx, w, r, appConfig)
+}
+
+// CachePolicy caches the output of a request for the duration given by its "cache_ttl"
+// parameter, falling back to the min_interval of its catalog query. Outputs are cached per
+// data source, with the cache size of the source; ad-hoc connections share one partition.
+func (h *SQLTaskHandler) CachePolicy(r *http.Request, appConfig config.Config) (tasks.CachePolicy, error) {
 	if r.Method != http.MethodGet {
-		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed")
+		return tasks.CachePolicy{}, nil
 	}
-
 	queryParams := r.URL.Query()
-	sqlQuery := queryParams.Get("query")
-	if sqlQuery == "" {
-		return nil, http.StatusBadRequest, fmt.Errorf("missing required parameter: query")
+	queryDef := appConfig.Queries[queryParams.Get("query_name")]
+	ttl := queryDef.MinInterval.ToStd()
+	if param := queryParams.Get("cache_ttl"); param != "" {
+		var err error
+		if ttl, err = time.ParseDuration(param); err != nil {
+			return tasks.CachePolicy{}, invalidRequest(err, "invalid cache_ttl")
+		}
+		if ttl < 0 {
+			return tasks.CachePolicy{}, dberrors.New(dberrors.CodeInvalidRequest, fmt.Sprintf("invalid cache_ttl: %s is negative", param))
+		}
 	}
 
-	dbType := queryParams.Get("type")
-	if dbType == "" {
-		return nil, http.StatusBadRequest, fmt.Errorf("missing required parameter: type")
+	sourceName := queryParams.Get("source")
+	if sourceName == "" && !hasAnyParam(queryParams, rawConnectionParams) {
+		sourceName = queryDef.Source
 	}
+	return tasks.CachePolicy{TTL: ttl, Partition: sourceName, MaxEntries: appConfig.CacheMaxEntriesFor(sourceName)}, nil
+}
 
-	username := queryParams.Get("username")
-	password := queryParams.Get("password")
-	host := queryParams.Get("host")
-	database := queryParams.Get("db")
+// handle executes the SQL query of the request. With a non-nil w the results may be streamed,
+// in which case streamed is true and the response has been written.
+func (h *SQLTaskHandler) handle(ctx context.Context, w http.ResponseWriter, r *http.Request, appConfig config.Config) (streamed bool, content []byte, status int, err error) {
+	if r.Method != http.MethodGet {
+		return failed(nil, dberrors.New(dberrors.CodeMethodNotAllowed, "method not allowed"))
+	}
 
-	if dbType != "sqlite" && dbType != "sqlite3" && (username == "" || host == "" || database == "") {
-		return nil, http.StatusBadRequest, fmt.Errorf("missing required connection parameters (username, host, db) for non-SQLite types")
+	queryParams := r.URL.Query()
+	queryDef, err := resolveQuery(queryParams, appConfig)
+	if err != nil {
+		return failed(nil, err)
 	}
-	if (dbType == "sqlite" || dbType == "sqlite3") && database == "" {
-		return nil, http.StatusBadRequest, fmt.Errorf("missing required parameter: db (database file path for SQLite)")
+	sqlQuery := queryDef.SQL
+	queryLabel := metric.QueryLabel(queryParams.Get("query_name"), sqlQuery)
+
+	src, connOpts, err := resolveDataSource(queryParams, appConfig, queryDef.Source)
+	if err != nil {
+		return failed(nil, invalidRequest(err, ""))
 	}
 
-	port := queryParams.Get("port")
-	valueColumn := queryParams.Get("value_column")
-	if valueColumn == "" {
-		valueColumn = "value" // Default value column
+	args, err := queryArgs(queryParams, queryDef.ArgTypes)
+	if err != nil {
+		return failed(nil, invalidRequest(err, "invalid query arguments"))
 	}
 
-	metricPrefix := queryParams.Get("metric_prefix")
-	if metricPrefix == "" {
+	valueColumn, valueColumns, err := resolveValueColumns(queryParams, queryDef)
+	if err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
+	nameColumn := firstNonEmpty(queryParams.Get("name_column"), queryDef.NameColumn)
+	metricPrefix := firstNonEmpty(queryParams.Get("metric_prefix"), queryDef.MetricPrefix)
+	if metricPrefix == "" && nameColumn == "" {
+		// Names taken from a name column are used as-is unless a prefix is given explicitly.
 		metricPrefix = appConfig.QueryMetricName // Default from global config
 	}
+	metricType, err := metric.ParseMetricType(firstNonEmpty(queryParams.Get("metric_type"), queryDef.MetricType))
+	if err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
+	metricHelp := firstNonEmpty(queryParams.Get("metric_help"), queryDef.Help)
+	onDuplicate, err := metric.ParseDuplicatePolicy(firstNonEmpty(queryParams.Get("on_duplicate"), queryDef.OnDuplicate))
+	if err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
+	mode, err := resolveMode(queryParams, queryDef)
+	if err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
+	nullValue, err := metric.ParseNullPolicy(firstNonEmpty(queryParams.Get("null_value"), queryDef.NullValue))
+	if err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
+	streamRequested := queryDef.Stream
+	if param := queryParams.Get("stream"); param != "" {
+		if streamRequested, err = strconv.ParseBool(param); err != nil {
+			return failed(nil, invalidRequest(err, "invalid stream"))
+		}
+	}
+
+	generator := metric.NewGenerator(metricPrefix, valueColumn)
+	generator.MetricPrefix = metricPrefix // May be empty when a name column is used
+	generator.Mode = mode
+	generator.ValueColumns = valueColumns
+	generator.NameColumn = nameColumn
+	generator.Type = metricType
+	generator.Help = metricHelp
+	generator.OnDuplicate = onDuplicate
+	generator.NullValue = nullValue
+	generator.TimestampColumn = firstNonEmpty(queryParams.Get("timestamp_column"), queryDef.TimestampColumn)
+	if err := applyDistributionParams(generator, queryParams, queryDef); err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
+	if err := applyLabelParams(generator, queryParams, queryDef); err != nil {
+		return failed(nil, invalidRequest(err, ""))
+	}
 	queryStatusMetricName := appConfig.QueryStatusMetricName
 
-	requestScopedMetricSet := metrics.NewSet()
-	var metricBuf bytes.Buffer
+	limits := appConfig.Limits
+	if src.Limits != nil {
+		limits = *src.Limits // Limits of a named source, filled in from the global limits
+	}
+	generator.MaxRows = limits.MaxRows
+	output, err := tasks.NewOutput(appConfig, limits)
+	if err != nil {
+		return failed(nil, err)
+	}
+	var stream *tasks.StreamOutput
+	if w != nil && streamRequested && canStream(generator, limits) {
+		if stream, err = tasks.NewStreamOutput(w, appConfig, limits); err != nil {
+			return failed(nil, err)
+		}
+	}
+
+	// Write protection is on unless the data source explicitly allows writes.
+	readOnly := !src.AllowWrites
+	if readOnly {
+		if err := db.CheckReadOnlyStatement(sqlQuery); err != nil {
+			err = dberrors.Wrap(dberrors.CodeStatementRejected, err, "statement rejected")
+			metric.RecordQueryStatus(output.Status, queryStatusMetricName, queryLabel, err)
+			return failed(output.Bytes(), err)
+		}
+	}
 
-	dsn, err := db.BuildDSN(dbType, username, password, host, port, database)
+	dsn, err := db.BuildSourceDSN(src)
 	if err != nil {
-		metric.RecordQueryStatus(requestScopedMetricSet, queryStatusMetricName, sqlQuery, err)
-		requestScopedMetricSet.WritePrometheus(&metricBuf)
-		return metricBuf.Bytes(), http.StatusBadRequest, fmt.Errorf("failed to build DSN: %w", err)
+		metric.RecordQueryStatus(output.Status, queryStatusMetricName, queryLabel, err)
+		return failed(output.Bytes(), invalidRequest(err, "failed to build DSN"))
 	}
 
-	// Use query timeout from appConfig for the context
-	queryCtx, cancel := context.WithTimeout(ctx, appConfig.ConnOptions.QueryTimeout.ToStd())
+	// Use the query timeout of the resolved connection options for the context
+	queryCtx, cancel := context.WithTimeout(ctx, connOpts.QueryTimeout.ToStd())
 	defer cancel()
 
-	conn, err := db.Open(queryCtx, dsn, appConfig.ConnOptions)
+	conn, err := h.pool.Get(queryCtx, dsn, connOpts)
 	if err != nil {
-		metric.RecordQueryStatus(requestScopedMetricSet, queryStatusMetricName, sqlQuery, err)
-		requestScopedMetricSet.WritePrometheus(&metricBuf)
-		return metricBuf.Bytes(), http.StatusInternalServerError, fmt.Errorf("failed to connect to database: %w", err)
+		metric.RecordQueryStatus(output.Status, queryStatusMetricName, queryLabel, err)
+		return failed(output.Bytes(), dberrors.Wrap(dberrors.CodeUnavailable, err, "failed to connect to database"))
 	}
-	defer conn.Close()
 
-	rows, err := conn.ExecuteQuery(queryCtx, sqlQuery)
+	var generateErr error
+	err = conn.Query(queryCtx, readOnly, sqlQuery, args, func(rows *stdsql.Rows) error {
+		if stream != nil {
+			// The query succeeded: start the response, errors from now on go to the trailing status
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			streamed = true
+			generateErr = generator.StreamFromRows(stream.Results, rows)
+		} else {
+			generateErr = generator.GenerateFromRows(output.Results, rows)
+		}
+		duplicateSeriesTotal.WithLabelValues(string(generator.OnDuplicate)).Add(float64(generator.Duplicates))
+		return generateErr
+	})
+	if streamed {
+		metric.RecordQueryStatus(stream.Status, queryStatusMetricName, queryLabel, err)
+		if err == nil && appConfig.QuerySkippedRowsMetricName != "" {
+			metric.RecordSkippedRows(stream.Status, appConfig.QuerySkippedRowsMetricName, queryLabel, generator.SkippedRows)
+		}
+		if finishErr := stream.Finish(); finishErr != nil {
+			return true, nil, http.StatusOK, dberrors.Wrap(dberrors.CodeInternal, finishErr, "failed to write metrics")
+		}
+		if generateErr != nil {
+			return true, nil, http.StatusOK, dberrors.Wrap(dberrors.CodeQueryFailed, err, "failed to generate metrics")
+		}
+		if err != nil {
+			return true, nil, http.StatusOK, dberrors.Wrap(dberrors.CodeQueryFailed, err, "failed to execute query")
+		}
+		return true, nil, http.StatusOK, nil
+	}
 	if err != nil {
-		metric.RecordQueryStatus(requestScopedMetricSet, queryStatusMetricName, sqlQuery, err)
-		requestScopedMetricSet.WritePrometheus(&metricBuf)
-		return metricBuf.Bytes(), http.StatusInternalServerError, fmt.Errorf("failed to execute query: %w", err)
+		metric.RecordQueryStatus(output.Status, queryStatusMetricName, queryLabel, err)
+		if generateErr != nil {
+			return failed(output.Bytes(), dberrors.Wrap(dberrors.CodeQueryFailed, err, "failed to generate metrics"))
+		}
+		return failed(output.Bytes(), dberrors.Wrap(dberrors.CodeQueryFailed, err, "failed to execute query"))
 	}
-	defer rows.Close()
 
-	generator := metric.NewGenerator(metricPrefix, valueColumn)
-	err = generator.GenerateFromRows(requestScopedMetricSet, rows)
+	if err := output.Check(); err != nil {
+		metric.RecordQueryStatus(output.Status, queryStatusMetricName, queryLabel, err)
+		return failed(output.Bytes(), err)
+	}
+	metric.RecordQueryStatus(output.Status, queryStatusMetricName, queryLabel, nil) // Record success
+	if appConfig.QuerySkippedRowsMetricName != "" {
+		metric.RecordSkippedRows(output.Status, appConfig.QuerySkippedRowsMetricName, queryLabel, generator.SkippedRows)
+	}
+	return false, output.Bytes(), http.StatusOK, nil
+}
+
+// failed returns the outcome of a request that failed with err before anything was streamed:
+// content, if any, is written with the HTTP status of the error code.
+func failed(content []byte, err error) (bool, []byte, int, error) {
+	return false, content, dberrors.HTTPStatus(err), err
+}
+
+// invalidRequest marks err as caused by invalid request parameters. An empty message keeps
+// the message of err.
+func invalidRequest(err error, message string) error {
+	return dberrors.Wrap(dberrors.CodeInvalidRequest, err, message)
+}
+
+// canStream reports whether results can be streamed: streaming is not possible if the generator
+// settings or the fail limit policy require the complete result before anything is written.
+func canStream(generator *metric.Generator, limits config.Limits) bool {
+	if err := generator.CheckStreamable(); err != nil {
+		slog.Debug("Buffering query results", "reason", err.Error())
+		return false
+	}
+	if limits.OnLimit == config.OnLimitFail {
+		slog.Debug("Buffering query results", "reason", "the on_limit policy is fail")
+		return false
+	}
+	return true
+}
+
+// resolveQuery returns the query to run: a catalog entry named by the "query_name"
+// parameter, or an ad-hoc query built from the "query" parameter.
+func resolveQuery(queryParams url.Values, appConfig config.Config) (config.QueryDefinition, error) {
+	queryName := queryParams.Get("query_name")
+	sqlQuery := queryParams.Get("query")
+
+	if queryName != "" {
+		if sqlQuery != "" {
+			return config.QueryDefinition{}, dberrors.New(dberrors.CodeInvalidRequest, "parameters query and query_name cannot be combined")
+		}
+		queryDef, ok := appConfig.Queries[queryName]
+		if !ok {
+			return config.QueryDefinition{}, dberrors.New(dberrors.CodeInvalidRequest, fmt.Sprintf("unknown query_name: %s", queryName))
+		}
+		return queryDef, nil
+	}
+
+	if sqlQuery == "" {
+		return config.QueryDefinition{}, dberrors.New(dberrors.CodeInvalidRequest, "missing required parameter: query")
+	}
+	if appConfig.CatalogOnly {
+		return config.QueryDefinition{}, dberrors.New(dberrors.CodeForbidden, "ad-hoc queries are disabled, use query_name")
+	}
+	return config.QueryDefinition{SQL: sqlQuery}, nil
+}
+
+// resolveValueColumns determines the value column(s) from the "value_column" or "value_columns"
+// parameter, falling back to the catalog definition. Request parameters take precedence.
+func resolveValueColumns(queryParams url.Values, queryDef config.QueryDefinition) (string, []metric.ValueColumn, error) {
+	valueColumn := queryParams.Get("value_column")
+	valueColumnsParam := queryParams.Get("value_columns")
+	if valueColumn != "" && valueColumnsParam != "" {
+		return "", nil, fmt.Errorf("parameters value_column and value_columns cannot be combined")
+	}
+
+	var specs []string
+	switch {
+	case valueColumnsParam != "":
+		specs = []string{valueColumnsParam}
+	case valueColumn == "" && len(queryDef.ValueColumns) > 0:
+		specs = queryDef.ValueColumns
+	}
+	valueColumns, err := metric.ParseValueColumns(specs...)
 	if err != nil {
-		metric.RecordQueryStatus(requestScopedMetricSet, queryStatusMetricName, sqlQuery, err)
-		requestScopedMetricSet.WritePrometheus(&metricBuf)
-		return metricBuf.Bytes(), http.StatusInternalServerError, fmt.Errorf("failed to generate metrics: %w", err)
+		return "", nil, err
+	}
+
+	return firstNonEmpty(valueColumn, queryDef.ValueColumn, "value"), valueColumns, nil
+}
+
+// resolveMode returns the generator mode from the "mode" parameter, falling back to the
+// catalog definition. Without a mode, an empty value_column or value_column=none selects info mode.
+func resolveMode(queryParams url.Values, queryDef config.QueryDefinition) (metric.Mode, error) {
+	mode := firstNonEmpty(queryParams.Get("mode"), queryDef.Mode)
+	if mode == "" {
+		valueColumn := queryDef.ValueColumn
+		if queryParams.Has("value_column") {
+			valueColumn = queryParams.Get("value_column")
+			if valueColumn == "" {
+				return metric.ModeInfo, nil
+			}
+		}
+		if strings.EqualFold(valueColumn, "none") {
+			return metric.ModeInfo, nil
+		}
+	}
+	return metric.ParseMode(mode)
+}
+
+// applyDistributionParams sets the histogram and summary options of the generator from the
+// "buckets", "bucket_column", "sum_column" and "quantiles" parameters, falling back to the
+// catalog definition, and validates them against the metric type.
+func applyDistributionParams(generator *metric.Generator, queryParams url.Values, queryDef config.QueryDefinition) error {
+	generator.Buckets = queryDef.Buckets
+	if param := queryParams.Get("buckets"); param != "" {
+		buckets, err := metric.ParseFloatList(param)
+		if err != nil {
+			return fmt.Errorf("invalid buckets: %w", err)
+		}
+		generator.Buckets = buckets
+	}
+	generator.Quantiles = queryDef.Quantiles
+	if param := queryParams.Get("quantiles"); param != "" {
+		quantiles, err := metric.ParseFloatList(param)
+		if err != nil {
+			return fmt.Errorf("invalid quantiles: %w", err)
+		}
+		generator.Quantiles = quantiles
+	}
+	generator.BucketColumn = firstNonEmpty(queryParams.Get("bucket_column"), queryDef.BucketColumn)
+	generator.SumColumn = firstNonEmpty(queryParams.Get("sum_column"), queryDef.SumColumn)
+	return generator.Validate()
+}
+
+// constLabelParamPrefix is the prefix of the request parameters that add constant labels.
+const constLabelParamPrefix = "const_label."
+
+// applyLabelParams sets the label shaping options of the generator from the "label_columns",
+// "drop_columns", "rename", "const_label.<name>" and "null_label_value" parameters.
+// Column lists replace the catalog values; renames and constant labels are merged over them.
+func applyLabelParams(generator *metric.Generator, queryParams url.Values, queryDef config.QueryDefinition) error {
+	generator.LabelColumns = queryDef.LabelColumns
+	if param := queryParams.Get("label_columns"); param != "" {
+		generator.LabelColumns = metric.ParseColumnList(param)
+	}
+	generator.DropColumns = queryDef.DropColumns
+	if param := queryParams.Get("drop_columns"); param != "" {
+		generator.DropColumns = metric.ParseColumnList(param)
 	}
 
-	metric.RecordQueryStatus(requestScopedMetricSet, queryStatusMetricName, sqlQuery, nil) // Record success
-	requestScopedMetricSet.WritePrometheus(&metricBuf)
-	return metricBuf.Bytes(), http.StatusOK, nil
+	renames, err := metric.ParseLabelRenames(queryParams["rename"]...)
+	if err != nil {
+		return err
+	}
+	generator.RenameLabels = make(map[string]string, len(queryDef.Rename)+len(renames))
+	for column, label := range queryDef.Rename {
+		generator.RenameLabels[column] = label
+	}
+	for column, label := range renames {
+		generator.RenameLabels[column] = label
+	}
+
+	constLabels := make(map[string]string, len(queryDef.ConstLabels))
+	for name, value := range queryDef.ConstLabels {
+		constLabels[name] = value
+	}
+	for param := range queryParams {
+		if name, ok := strings.CutPrefix(param, constLabelParamPrefix); ok {
+			constLabels[name] = queryParams.Get(param)
+		}
+	}
+	generator.ConstLabels, err = metric.LabelsFromMap(constLabels)
+	if err != nil {
+		return fmt.Errorf("invalid constant label: %w", err)
+	}
+
+	generator.NullLabelValue = firstNonEmpty(queryParams.Get("null_label_value"), queryDef.NullLabelValue)
+	return nil
+}
+
+// rawConnectionParams are the request parameters that carry connection details directly.
+var rawConnectionParams = []string{"type", "username", "password", "host", "port", "db"}
+
+// resolveDataSource determines which database the request targets, either a
+// data source named by the "source" parameter or an ad-hoc one described by
+// the raw connection parameters, along with the connection options to use.
+// defaultSource is used when the request names neither.
+func resolveDataSource(queryParams url.Values, appConfig config.Config, defaultSource string) (config.DataSource, config.ConnectionOptions, error) {
+	sourceName := queryParams.Get("source")
+	if sourceName == "" && defaultSource != "" && !hasAnyParam(queryParams, rawConnectionParams) {
+		sourceName = defaultSource
+	}
+	if sourceName != "" {
+		for _, p := range rawConnectionParams {
+			if queryParams.Has(p) {
+				return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("parameter %s cannot be combined with source", p)
+			}
+		}
+		src, ok := appConfig.DataSources[sourceName]
+		if !ok {
+			return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("unknown data source: %s", sourceName)
+		}
+		return src, appConfig.ConnOptionsFor(sourceName), nil
+	}
+
+	if appConfig.DisableRawCredentials {
+		return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("raw connection parameters are disabled, use the source parameter")
+	}
+
+	src := config.DataSource{
+		Type:     queryParams.Get("type"),
+		Username: queryParams.Get("username"),
+		Password: queryParams.Get("password"),
+		Host:     queryParams.Get("host"),
+		Database: queryParams.Get("db"),
+	}
+	if src.Type == "" {
+		return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("missing required parameter: type")
+	}
+
+	isSQLite := src.Type == "sqlite" || src.Type == "sqlite3"
+	if !isSQLite && (src.Username == "" || src.Host == "" || src.Database == "") {
+		return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("missing required connection parameters (username, host, db) for non-SQLite types")
+	}
+	if isSQLite && src.Database == "" {
+		return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("missing required parameter: db (database file path for SQLite)")
+	}
+
+	if portStr := queryParams.Get("port"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return config.DataSource{}, config.ConnectionOptions{}, fmt.Errorf("invalid port: %w", err)
+		}
+		src.Port = port
+	}
+	return src, appConfig.ConnOptions, nil
+}
+
+// hasAnyParam reports whether any of the named parameters is present in the request.
+func hasAnyParam(queryParams url.Values, names []string) bool {
+	for _, name := range names {
+		if queryParams.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstNonEmpty returns the first of the given values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
 }
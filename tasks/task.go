@@ -8,8 +8,22 @@ import (
 
 // TaskHandler defines the interface for a component that can handle a specific type of task
 // initiated by an HTTP request, process it, and return results suitable for metrics.
+// Handlers build their metrics with an Output (see NewOutput), which applies the output limits
+// of the config.
 type TaskHandler interface {
 	// Handle processes the incoming HTTP request, executes the task,
 	// and returns the Prometheus-formatted metrics content, an HTTP status code, and any error.
+	// Errors carry a code (see the errors package) that decides the status code.
 	Handle(ctx context.Context, r *http.Request, appConfig config.Config) (metricContent []byte, httpStatusCode int, err error)
 }
+
+// StreamingTaskHandler is a TaskHandler that can also write its metrics to the response while
+// the task runs, using a StreamOutput, instead of returning them once the task is complete.
+type StreamingTaskHandler interface {
+	TaskHandler
+	// HandleStream processes the request like Handle, but may stream the metrics to w. If it did,
+	// it returns streamed as true: the status code and content have been written, and an error
+	// that occurred afterwards is only reported by the trailing status metrics. Otherwise it
+	// returns the content, status code and error as Handle does, for the caller to write.
+	HandleStream(ctx context.Context, w http.ResponseWriter, r *http.Request, appConfig config.Config) (streamed bool, metricContent []byte, httpStatusCode int, err error)
+}
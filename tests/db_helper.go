@@ -15,7 +15,7 @@ import (
 )
 
 // generateTestDBPath creates a unique path for a test SQLite database
-func generateTestDBPath(t *testing.T) string {
+func generateTestDBPath(t testing.TB) string {
 	tempDir := os.TempDir()
 	// Sanitize the test name to be filesystem-friendly
 	safeTestName := strings.ReplaceAll(t.Name(), "/", "_")
@@ -27,7 +27,7 @@ func generateTestDBPath(t *testing.T) string {
 
 // SetupTestDB creates a SQLite database with test data for testing
 // It now returns the path to the created database along with the connection and cleanup function.
-func SetupTestDB(t *testing.T) (*db.Connection, string, func()) {
+func SetupTestDB(t testing.TB) (*db.Connection, string, func()) {
 	currentTestDBPath := generateTestDBPath(t)
 	// Force removal of any existing test database file *before* anything else.
 	if err := os.Remove(currentTestDBPath); err != nil && !os.IsNotExist(err) {
@@ -89,7 +89,7 @@ func SetupTestDB(t *testing.T) (*db.Connection, string, func()) {
 }
 
 // createTestData creates tables and populates them with test data
-func createTestData(t *testing.T, db *sql.DB, dbPath string) {
+func createTestData(t testing.TB, db *sql.DB, dbPath string) {
 	// Drop tables if they exist to ensure a clean state for each test
 	// Using the specific db connection ensures we are acting on the correct database.
 	_, err := db.Exec(`DROP TABLE IF EXISTS tables`)
@@ -187,7 +187,7 @@ func createTestData(t *testing.T, db *sql.DB, dbPath string) {
 }
 
 // CreateLargeTable creates a table with a large number of rows for stress testing.
-func CreateLargeTable(t *testing.T, db *sql.DB, tableName string, rowCount int) {
+func CreateLargeTable(t testing.TB, db *sql.DB, tableName string, rowCount int) {
 	// Drop table if it exists to ensure a clean state
 	_, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName))
 	if err != nil {